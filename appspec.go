@@ -1,15 +1,19 @@
 package main
 
 import (
-	"archive/zip"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"os/user"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/Luzifer/go_helpers/env"
@@ -17,35 +21,95 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
+const (
+	fileExistsDisallow  = "DISALLOW"
+	fileExistsOverwrite = "OVERWRITE"
+	fileExistsRetain    = "RETAIN"
+)
+
+func validateFileExistsBehavior(behavior string) error {
+	switch behavior {
+	case fileExistsDisallow, fileExistsOverwrite, fileExistsRetain:
+		return nil
+	default:
+		return fmt.Errorf("Unsupported file_exists_behavior %q (DISALLOW, OVERWRITE, RETAIN)", behavior)
+	}
+}
+
 type appspecFile struct {
 	Source      string `file:"source"`
 	Destination string `file:"destination"`
 }
 
-func (a appspecFile) copyFile(f *zip.File, stripPrefix string) error {
-	targetFile := path.Join(a.Destination, strings.TrimPrefix(f.Name, stripPrefix))
+func (a appspecFile) target(f *archiveFile, stripPrefix string) string {
+	return path.Join(a.Destination, strings.TrimPrefix(f.Name, stripPrefix))
+}
+
+// copyFile installs the file to its destination and reports whether the
+// file was written. Files installed by the previous revision are always
+// replaced regardless of the file_exists_behavior.
+func (a appspecFile) copyFile(f *archiveFile, stripPrefix, fileExistsBehavior string, previous map[string]bool) (bool, error) {
+	targetFile := a.target(f, stripPrefix)
 
+	if fileExistsBehavior == fileExistsRetain && fileExists(targetFile) && !previous[targetFile] {
+		// Existing files not installed by us are left untouched
+		return false, nil
+	}
+
+	return true, a.writeFile(f, targetFile)
+}
+
+func (a appspecFile) writeFile(f *archiveFile, targetFile string) error {
 	if err := os.MkdirAll(path.Dir(targetFile), 0755); err != nil {
 		return fmt.Errorf("Unable to create destination directory %q: %s", a.Destination, err)
 	}
 
-	fp, err := os.OpenFile(targetFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, f.Mode())
+	if f.Mode&os.ModeSymlink != 0 {
+		if err := os.Remove(targetFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Unable to replace destination %q: %s", targetFile, err)
+		}
+		if err := os.Symlink(f.Link, targetFile); err != nil {
+			return fmt.Errorf("Unable to create symlink %q: %s", targetFile, err)
+		}
+		return a.setOwner(f, targetFile)
+	}
+
+	fp, err := os.OpenFile(targetFile, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, f.Mode)
 	if err != nil {
 		return fmt.Errorf("Unable to open destination %q for writing: %s", targetFile, err)
 	}
 	defer fp.Close()
 
-	zfp, err := f.Open()
+	afp, err := f.Open()
 	if err != nil {
-		return fmt.Errorf("Unable to read source %q from ZIP file: %s", f.Name, err)
+		return fmt.Errorf("Unable to read source %q from archive: %s", f.Name, err)
 	}
-	defer zfp.Close()
+	defer afp.Close()
 
-	_, err = io.Copy(fp, zfp)
-	return err
+	if _, err = io.Copy(fp, afp); err != nil {
+		return err
+	}
+
+	return a.setOwner(f, targetFile)
 }
 
-func (a appspecFile) Execute(zipFile *zip.Reader) error {
+// setOwner transfers the ownership stored in the archive to the target
+// file. This is only possible when running as root and for archive
+// formats storing the owner.
+func (a appspecFile) setOwner(f *archiveFile, targetFile string) error {
+	if !f.HasOwner || os.Geteuid() != 0 {
+		return nil
+	}
+
+	if err := os.Lchown(targetFile, f.UID, f.GID); err != nil {
+		return fmt.Errorf("Unable to set owner of %q: %s", targetFile, err)
+	}
+	return nil
+}
+
+// sourceFiles returns the files of the archive to install and the prefix
+// to strip from their names
+func (a appspecFile) sourceFiles(archive deploymentArchive) ([]*archiveFile, string) {
 	// https://docs.aws.amazon.com/codedeploy/latest/userguide/reference-appspec-file-structure-files.html
 	//
 	// - If source refers to a file, only the specified files are copied to the instance.
@@ -55,11 +119,9 @@ func (a appspecFile) Execute(zipFile *zip.Reader) error {
 	//
 	// Note: This tool does not have Windows support!
 
-	for _, f := range zipFile.File {
-		if f.Name == a.Source {
-			// Exact match (case 1)
-			return a.copyFile(f, path.Dir(f.Name))
-		}
+	if f := findArchiveFile(archive, a.Source); f != nil && !f.Mode.IsDir() {
+		// Exact match (case 1)
+		return []*archiveFile{f}, path.Dir(f.Name)
 	}
 
 	// No exact match, fall back to prefix matching
@@ -68,42 +130,127 @@ func (a appspecFile) Execute(zipFile *zip.Reader) error {
 		a.Source = ""
 	}
 
-	for _, f := range zipFile.File {
-		if strings.HasPrefix(f.Name, a.Source) && !f.FileInfo().IsDir() {
-			if err := a.copyFile(f, a.Source); err != nil {
-				return err
-			}
+	files := []*archiveFile{}
+	for _, f := range archive.Files() {
+		if strings.HasPrefix(f.Name, a.Source) && !f.Mode.IsDir() {
+			files = append(files, f)
 		}
 	}
 
-	return nil
+	return files, a.Source
 }
 
-type appspecHook struct {
-	Location string `yaml:"location"`
-	Timeout  int    `yaml:"timeout"`
-	RunAs    string `yaml:"runas"`
+// existingTargets returns the destinations already existing on the
+// system which would be replaced by installing the files and which were
+// not installed by the previous revision
+func (a appspecFile) existingTargets(archive deploymentArchive, previous map[string]bool) []string {
+	existing := []string{}
+
+	files, stripPrefix := a.sourceFiles(archive)
+	for _, f := range files {
+		if t := a.target(f, stripPrefix); fileExists(t) && !previous[t] {
+			existing = append(existing, t)
+		}
+	}
+
+	return existing
 }
 
-func (a appspecHook) Execute(zipFile *zip.Reader, logger *log.Entry, envMeta map[string]string) error {
-	var (
-		err    error
-		script io.ReadCloser
-	)
+// Execute installs the files and returns the destinations written, also
+// in case of an error
+func (a appspecFile) Execute(archive deploymentArchive, fileExistsBehavior string, previous map[string]bool) ([]string, error) {
+	installed := []string{}
 
-	for _, f := range zipFile.File {
-		if f.Name == a.Location {
-			script, err = f.Open()
-			if err != nil {
-				return fmt.Errorf("Unable to open script %q from ZIP file: %s", a.Location, err)
-			}
-			defer script.Close()
-			break
+	files, stripPrefix := a.sourceFiles(archive)
+	for _, f := range files {
+		written, err := a.copyFile(f, stripPrefix, fileExistsBehavior, previous)
+		if written {
+			installed = append(installed, a.target(f, stripPrefix))
+		}
+		if err != nil {
+			return installed, err
 		}
 	}
 
-	if script == nil {
-		return fmt.Errorf("Script %q not found in ZIP file", a.Location)
+	return installed, nil
+}
+
+const (
+	hookDefaultInterpreter = "/bin/bash"
+	hookShebangMaxLength   = 256
+)
+
+type appspecHook struct {
+	Location    string `yaml:"location"`
+	Timeout     int    `yaml:"timeout"`
+	RunAs       string `yaml:"runas"`
+	Interpreter string `yaml:"interpreter"`
+}
+
+// command determines how to execute the script: The interpreter set in
+// the appspec takes precedence, executable files are executed directly
+// (honoring their shebang) and other files are passed to the interpreter
+// of their shebang or to bash if they have none.
+func (a appspecHook) command(script string) ([]string, error) {
+	if a.Interpreter != "" {
+		return append(strings.Fields(a.Interpreter), script), nil
+	}
+
+	stat, err := os.Stat(script)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Mode()&0111 != 0 {
+		return []string{script}, nil
+	}
+
+	f, err := os.Open(script)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	head := make([]byte, hookShebangMaxLength)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	if !bytes.HasPrefix(head, []byte("#!")) {
+		return []string{hookDefaultInterpreter, script}, nil
+	}
+
+	line := head[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	// Like the kernel everything after the interpreter is passed as a
+	// single argument
+	shebang := strings.TrimSpace(string(line))
+	if shebang == "" {
+		return nil, fmt.Errorf("Script %q has an empty shebang line", a.Location)
+	}
+
+	if i := strings.IndexAny(shebang, " \t"); i >= 0 {
+		return []string{shebang[:i], strings.TrimSpace(shebang[i:]), script}, nil
+	}
+	return []string{shebang, script}, nil
+}
+
+func (a appspecHook) Execute(archive deploymentArchive, root string, logger *log.Entry, envMeta map[string]string) error {
+	f := findArchiveFile(archive, a.Location)
+	if f == nil || !f.Mode.IsRegular() {
+		return fmt.Errorf("Script %q not found in archive", a.Location)
+	}
+
+	// The script is executed from the extracted bundle
+	script := path.Join(root, f.Name)
+
+	argv, err := a.command(script)
+	if err != nil {
+		return fmt.Errorf("Unable to determine how to execute script %q: %s", a.Location, err)
 	}
 
 	if a.Timeout == 0 {
@@ -123,98 +270,423 @@ func (a appspecHook) Execute(zipFile *zip.Reader, logger *log.Entry, envMeta map
 		environ[k] = v
 	}
 
-	cmd := exec.CommandContext(ctx, "/bin/bash")
-	cmd.Stdin = script
-	cmd.Stdout = stdout
-	cmd.Stderr = stderr
-	cmd.Env = env.MapToList(environ)
+	run := func(argv []string) error {
+		cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		cmd.Env = env.MapToList(environ)
+		cmd.Dir = root
+
+		// OS specific function, see in appspec_GOOS.go files
+		if err := a.setRunAs(cmd); err != nil {
+			return fmt.Errorf("Unable to set RunAs user: %s", err)
+		}
 
-	// OS specific function, see in appspec_GOOS.go files
-	if err := a.setRunAs(cmd); err != nil {
-		return fmt.Errorf("Unable to set RunAs user: %s", err)
+		return cmd.Run()
 	}
 
-	return cmd.Run()
+	err = run(argv)
+	if errors.Is(err, syscall.ENOEXEC) {
+		// Executable file without shebang which is not a binary either
+		err = run([]string{hookDefaultInterpreter, script})
+	}
+
+	return err
+}
+
+type appspecPermission struct {
+	Object  string   `yaml:"object"`
+	Pattern string   `yaml:"pattern"`
+	Except  []string `yaml:"except"`
+	Owner   string   `yaml:"owner"`
+	Group   string   `yaml:"group"`
+	Mode    string   `yaml:"mode"`
+	// ACLs ignored
+	// Context ignored
+	Type []string `yaml:"type"`
+}
+
+// resolve validates the permission definition and returns the numeric
+// owner / group (-1 if not set) and the mode to apply
+func (a appspecPermission) resolve() (uid, gid int, mode os.FileMode, err error) {
+	if !path.IsAbs(a.Object) {
+		return 0, 0, 0, fmt.Errorf("Object %q is not an absolute path", a.Object)
+	}
+
+	for _, p := range append([]string{a.Pattern}, a.Except...) {
+		if _, err := path.Match(p, ""); err != nil {
+			return 0, 0, 0, fmt.Errorf("Invalid pattern %q: %s", p, err)
+		}
+	}
+
+	for _, t := range a.Type {
+		if t != "file" && t != "directory" {
+			return 0, 0, 0, fmt.Errorf("Unsupported type %q", t)
+		}
+	}
+
+	if a.Owner == "" && a.Group == "" && a.Mode == "" {
+		return 0, 0, 0, fmt.Errorf("Neither owner, group nor mode set for %q", a.Object)
+	}
+
+	if uid, err = lookupUID(a.Owner); err != nil {
+		return 0, 0, 0, err
+	}
+	if gid, err = lookupGID(a.Group); err != nil {
+		return 0, 0, 0, err
+	}
+
+	if a.Mode != "" {
+		m, err := strconv.ParseUint(a.Mode, 8, 32)
+		if err != nil || m > 07777 {
+			return 0, 0, 0, fmt.Errorf("Invalid mode %q", a.Mode)
+		}
+
+		mode = os.FileMode(m & 0777)
+		if m&04000 != 0 {
+			mode |= os.ModeSetuid
+		}
+		if m&02000 != 0 {
+			mode |= os.ModeSetgid
+		}
+		if m&01000 != 0 {
+			mode |= os.ModeSticky
+		}
+	}
+
+	return uid, gid, mode, nil
+}
+
+// appliesTo checks whether the permission applies to the given type of
+// objects (file or directory), without types it applies to both
+func (a appspecPermission) appliesTo(info os.FileInfo) bool {
+	if len(a.Type) == 0 {
+		return true
+	}
+
+	t := "file"
+	if info.IsDir() {
+		t = "directory"
+	}
+
+	for _, at := range a.Type {
+		if at == t {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks whether the permission applies to the file at the given
+// path below the object
+func (a appspecPermission) matches(name string, info os.FileInfo) bool {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0, !a.appliesTo(info):
+		return false
+	case a.Pattern == "" || a.Pattern == "**":
+		return true
+	}
+
+	ok, _ := path.Match(a.Pattern, path.Base(name))
+	return ok
+}
+
+func (a appspecPermission) Execute() error {
+	// https://docs.aws.amazon.com/codedeploy/latest/userguide/reference-appspec-file-structure-permissions.html
+	//
+	// - If object refers to a file the permissions are applied to that file.
+	// - If object refers to a directory the permissions are applied to all
+	//   files and directories below it matching the pattern (`**` or no
+	//   pattern for all) and none of the except patterns.
+	//
+	// Note: ACLs and SELinux contexts are not supported!
+
+	uid, gid, mode, err := a.resolve()
+	if err != nil {
+		return err
+	}
+
+	apply := func(name string) error {
+		if uid >= 0 || gid >= 0 {
+			if err := os.Chown(name, uid, gid); err != nil {
+				return fmt.Errorf("Unable to set owner of %q: %s", name, err)
+			}
+		}
+		if a.Mode != "" {
+			if err := os.Chmod(name, mode); err != nil {
+				return fmt.Errorf("Unable to set mode of %q: %s", name, err)
+			}
+		}
+		return nil
+	}
+
+	info, err := os.Lstat(a.Object)
+	if err != nil {
+		return fmt.Errorf("Unable to access object %q: %s", a.Object, err)
+	}
+
+	if !info.IsDir() {
+		if info.Mode()&os.ModeSymlink != 0 || !a.appliesTo(info) {
+			return nil
+		}
+		return apply(a.Object)
+	}
+
+	return filepath.Walk(a.Object, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if name == a.Object {
+			return nil
+		}
+
+		for _, e := range a.Except {
+			if ok, _ := path.Match(e, path.Base(name)); ok {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if !a.matches(name, info) {
+			return nil
+		}
+
+		return apply(name)
+	})
+}
+
+// lookupUID resolves a user name or numeric UID, -1 is returned for an
+// empty user to leave the owner unchanged
+func lookupUID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+
+	if uid, err := strconv.Atoi(name); err == nil {
+		return uid, nil
+	}
+
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find UID for user %q: %s", name, err)
+	}
+
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return 0, fmt.Errorf("User %q had no numeric UID: %s", name, err)
+	}
+	return uid, nil
+}
+
+// lookupGID resolves a group name or numeric GID, -1 is returned for an
+// empty group to leave the group unchanged
+func lookupGID(name string) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+
+	grp, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to find GID for group %q: %s", name, err)
+	}
+
+	gid, err := strconv.Atoi(grp.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("Group %q had no numeric GID: %s", name, err)
+	}
+	return gid, nil
+}
+
+// fileExists checks whether anything (including a dangling symlink)
+// exists at the given path
+func fileExists(name string) bool {
+	_, err := os.Lstat(name)
+	return err == nil
 }
 
 type appspec struct {
 	Version float64 `yaml:"version"`
 	// OS ignored
-	Files []appspecFile `yaml:"files"`
-	// Permissions ignored
-	Hooks map[string][]appspecHook `yaml:"hooks"`
+	Files              []appspecFile            `yaml:"files"`
+	FileExistsBehavior string                   `yaml:"file_exists_behavior"`
+	Permissions        []appspecPermission      `yaml:"permissions"`
+	Hooks              map[string][]appspecHook `yaml:"hooks"`
 }
 
-func parseZIPAppSpec(zipFile *zip.Reader) (*appspec, error) {
-	for _, f := range zipFile.File {
-		if f.Name == "appspec.yml" {
-			fr, err := f.Open()
-			if err != nil {
-				return nil, err
-			}
-			defer fr.Close()
+func parseAppSpec(archive deploymentArchive) (*appspec, error) {
+	f := findArchiveFile(archive, "appspec.yml")
+	if f == nil || !f.Mode.IsRegular() {
+		return nil, errors.New("appspec.yml not found in archive")
+	}
 
-			as := &appspec{}
-			return as, yaml.NewDecoder(fr).Decode(as)
-		}
+	fr, err := f.Open()
+	if err != nil {
+		return nil, err
 	}
+	defer fr.Close()
+
+	as := &appspec{}
+	return as, yaml.NewDecoder(fr).Decode(as)
+}
+
+// appspecRevision is the previously deployed revision whose ApplicationStop
+// hooks are executed before the new revision is installed
+type appspecRevision struct {
+	DeploymentID string
+	Appspec      *appspec
+	Archive      deploymentArchive
+	// Root contains the extracted bundle of the revision
+	Root string
+	// Installed contains the files installed by the revision
+	Installed map[string]bool
+
+	artifact io.Closer
+}
 
-	return nil, errors.New("appspec.yml not found in ZIP file")
+// Close releases the archive and the artifact of the revision
+func (a appspecRevision) Close() error {
+	err := a.Archive.Close()
+	if cerr := a.artifact.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Execute runs the directives specified inside the appspec definition
-func (a appspec) Execute(zipFile *zip.Reader, logger *log.Entry, deploymentID string) error {
+// with the hooks being executed inside the root containing the extracted
+// bundle. If a previous revision is given its ApplicationStop hooks are
+// executed first and the files it installed are replaced regardless of
+// the file_exists_behavior. The files written by the install step are
+// returned (also if the deployment failed afterwards).
+func (a appspec) Execute(archive deploymentArchive, root string, logger *log.Entry, deploymentID string, metadata map[string]string, previous *appspecRevision) ([]string, error) {
 	if err := a.Validate(); err != nil {
-		return err
+		return nil, err
+	}
+
+	hookEnv := func(lifecycleEvent, root string, hookMetadata map[string]string) map[string]string {
+		environ := metadataEnvironment(hookMetadata)
+		environ["APPLICATION_NAME"] = cfg.SoftwareIdentifier
+		environ["DEPLOYMENT_ID"] = deploymentID
+		environ["LIFECYCLE_EVENT"] = lifecycleEvent
+		if root != "" {
+			environ["DEPLOYMENT_ROOT"] = root
+		}
+		return environ
 	}
 
 	// Flow definition
 	// https://docs.aws.amazon.com/codedeploy/latest/userguide/reference-appspec-file-structure-hooks.html
-	// [Start] => [DownloadBundle] => BeforeInstall => [Install] => AfterInstall => ApplicationStart => ValidateService => [End]
-	// Unsupported: ApplicationStop, tasks need to be moved to BeforeInstall
+	// [Start] => ApplicationStop => [DownloadBundle] => BeforeInstall => [Install] => AfterInstall => ApplicationStart => ValidateService => [End]
+	// ApplicationStop is executed from the previous revision (if retained)
 	// [] = System tasks, all others are definable by users
 
-	if hooks, ok := a.Hooks["BeforeInstall"]; ok {
-		for _, hook := range hooks {
-			if err := hook.Execute(zipFile, logger, map[string]string{
-				"APPLICATION_NAME": cfg.SoftwareIdentifier,
-				"DEPLOYMENT_ID":    deploymentID,
-				"LIFECYCLE_EVENT":  "BeforeInstall",
-			}); err != nil {
-				return fmt.Errorf("Hook \"BeforeInstall\" failed: %s", err)
+	var (
+		fileExistsBehavior = a.fileExistsBehavior()
+		previousInstalled  map[string]bool
+	)
+
+	if previous != nil {
+		previousInstalled = previous.Installed
+	}
+
+	if fileExistsBehavior == fileExistsDisallow {
+		// Check all files before stopping the application or writing any
+		// file to not leave a stopped application or a partial install
+		existing := []string{}
+		for _, af := range a.Files {
+			existing = append(existing, af.existingTargets(archive, previousInstalled)...)
+		}
+
+		if len(existing) > 0 {
+			return nil, fmt.Errorf("File operation failed: %d file(s) already exist and file_exists_behavior is DISALLOW: %s",
+				len(existing), strings.Join(existing, ", "))
+		}
+	}
+
+	if previous != nil {
+		// The metadata of the new artifact does not describe the previous
+		// revision and the metadata of the previous artifact is not retained
+		stopLogger := logger.WithField("previous_deployment_id", previous.DeploymentID)
+		stopEnv := hookEnv("ApplicationStop", previous.Root, nil)
+		if err := previous.Appspec.executeHooks("ApplicationStop", previous.Archive, previous.Root, stopLogger, stopEnv); err != nil {
+			if !cfg.IgnoreStopFailures {
+				return nil, err
 			}
+			stopLogger.WithError(err).Warn("Ignoring ApplicationStop failure")
 		}
 	}
 
+	if err := a.executeHooks("BeforeInstall", archive, root, logger, hookEnv("BeforeInstall", root, metadata)); err != nil {
+		return nil, err
+	}
+
 	// Install
+	installed := []string{}
+
 	for _, af := range a.Files {
-		if err := af.Execute(zipFile); err != nil {
-			return fmt.Errorf("File operation failed: %s", err)
+		written, err := af.Execute(archive, fileExistsBehavior, previousInstalled)
+		installed = append(installed, written...)
+		if err != nil {
+			return installed, fmt.Errorf("File operation failed: %s", err)
+		}
+	}
+
+	for _, ap := range a.Permissions {
+		if err := ap.Execute(); err != nil {
+			return installed, fmt.Errorf("Permission operation failed: %s", err)
 		}
 	}
 
 	for _, hookName := range []string{"AfterInstall", "ApplicationStart", "ValidateService"} {
-		if hooks, ok := a.Hooks[hookName]; ok {
-			for _, hook := range hooks {
-				if err := hook.Execute(zipFile, logger, map[string]string{
-					"APPLICATION_NAME": cfg.SoftwareIdentifier,
-					"DEPLOYMENT_ID":    deploymentID,
-					"LIFECYCLE_EVENT":  hookName,
-				}); err != nil {
-					return fmt.Errorf("Hook %q failed: %s", hookName, err)
-				}
-			}
+		if err := a.executeHooks(hookName, archive, root, logger, hookEnv(hookName, root, metadata)); err != nil {
+			return installed, err
 		}
 	}
 
+	return installed, nil
+}
+
+// executeHooks runs all hooks defined for the lifecycle event
+func (a appspec) executeHooks(lifecycleEvent string, archive deploymentArchive, root string, logger *log.Entry, envMeta map[string]string) error {
+	for _, hook := range a.Hooks[lifecycleEvent] {
+		if err := hook.Execute(archive, root, logger, envMeta); err != nil {
+			return fmt.Errorf("Hook %q failed: %s", lifecycleEvent, err)
+		}
+	}
 	return nil
 }
 
+// fileExistsBehavior returns the behavior for files already existing at
+// the destination: The appspec overrides the default from the CLI.
+func (a appspec) fileExistsBehavior() string {
+	if a.FileExistsBehavior != "" {
+		return strings.ToUpper(a.FileExistsBehavior)
+	}
+	return strings.ToUpper(cfg.FileExistsBehavior)
+}
+
 // Validate executes some basic tests on the parsed appspec definition
 func (a appspec) Validate() error {
 	if a.Version != 0.0 {
 		return errors.New("Unsupported appspec version")
 	}
 
+	if err := validateFileExistsBehavior(a.fileExistsBehavior()); err != nil {
+		return err
+	}
+
+	for i, ap := range a.Permissions {
+		if _, _, _, err := ap.resolve(); err != nil {
+			return fmt.Errorf("Invalid permission %d: %s", i+1, err)
+		}
+	}
+
 	return nil
 }
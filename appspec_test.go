@@ -0,0 +1,299 @@
+package main
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newTestRevision extracts an archive containing the given config file
+// and a hook script writing a marker file for every lifecycle event which
+// contains the commit passed as metadata
+func newTestRevision(t *testing.T, config string) (deploymentArchive, string) {
+	hook := "#!/bin/sh\nprintf '%s' \"$DEPLOY_META_COMMIT\" >\"hook-$LIFECYCLE_EVENT\"\n"
+	a := newTestTarArchive(t, []testArchiveEntry{
+		{hdr: tar.Header{Name: "config.ini", Typeflag: tar.TypeReg, Mode: 0644}, content: config},
+		{hdr: tar.Header{Name: "hook.sh", Typeflag: tar.TypeReg, Mode: 0755}, content: hook},
+	})
+
+	root := tempTestDir(t)
+	if err := extractArchive(a, root); err != nil {
+		t.Fatalf("Extraction failed: %s", err)
+	}
+	return a, root
+}
+
+func newTestAppspec(dest, fileExistsBehavior string) *appspec {
+	hooks := map[string][]appspecHook{}
+	for _, event := range []string{"ApplicationStop", "BeforeInstall", "AfterInstall"} {
+		hooks[event] = []appspecHook{{Location: "hook.sh"}}
+	}
+
+	return &appspec{
+		Files: []appspecFile{
+			{Source: "config.ini", Destination: dest},
+		},
+		FileExistsBehavior: fileExistsBehavior,
+		Hooks:              hooks,
+	}
+}
+
+func TestAppspecFileExistsBehavior(t *testing.T) {
+	logger := log.NewEntry(log.StandardLogger())
+
+	for name, c := range map[string]struct {
+		behavior          string
+		installedBefore   bool
+		expectedContent   string
+		expectedInstalled int
+		fails             bool
+	}{
+		"DISALLOW foreign file":    {behavior: fileExistsDisallow, expectedContent: "foreign", fails: true},
+		"DISALLOW previous file":   {behavior: fileExistsDisallow, installedBefore: true, expectedContent: "new", expectedInstalled: 1},
+		"OVERWRITE foreign file":   {behavior: fileExistsOverwrite, expectedContent: "new", expectedInstalled: 1},
+		"RETAIN foreign file":      {behavior: fileExistsRetain, expectedContent: "foreign"},
+		"RETAIN previous file":     {behavior: fileExistsRetain, installedBefore: true, expectedContent: "new", expectedInstalled: 1},
+		"lowercase behavior is ok": {behavior: "overwrite", expectedContent: "new", expectedInstalled: 1},
+	} {
+		func() {
+			dest := tempTestDir(t)
+			defer os.RemoveAll(dest)
+
+			target := path.Join(dest, "config.ini")
+			if err := ioutil.WriteFile(target, []byte("foreign"), 0644); err != nil {
+				t.Fatalf("Unable to write existing file: %s", err)
+			}
+
+			prevArchive, prevRoot := newTestRevision(t, "previous")
+			defer os.RemoveAll(prevRoot)
+			previous := &appspecRevision{
+				DeploymentID: "1",
+				Appspec:      newTestAppspec(dest, ""),
+				Archive:      prevArchive,
+				Root:         prevRoot,
+				Installed:    map[string]bool{target: c.installedBefore},
+			}
+
+			archive, root := newTestRevision(t, "new")
+			defer os.RemoveAll(root)
+
+			installed, err := newTestAppspec(dest, c.behavior).Execute(archive, root, logger, "2", nil, previous)
+			switch {
+			case c.fails && err == nil:
+				t.Errorf("%s: Expected error", name)
+			case !c.fails && err != nil:
+				t.Errorf("%s: Unexpected error: %s", name, err)
+			}
+
+			if content, _ := ioutil.ReadFile(target); string(content) != c.expectedContent {
+				t.Errorf("%s: Expected content %q, got %q", name, c.expectedContent, content)
+			}
+
+			if len(installed) != c.expectedInstalled {
+				t.Errorf("%s: Expected %d installed file(s), got %v", name, c.expectedInstalled, installed)
+			}
+
+			// A refused deployment neither stops the previous revision
+			// nor runs any hook of the new one
+			for dir, event := range map[string]string{prevRoot: "ApplicationStop", root: "BeforeInstall"} {
+				if ran := fileExists(path.Join(dir, "hook-"+event)); ran == c.fails {
+					t.Errorf("%s: Hook %s executed: %v", name, event, ran)
+				}
+			}
+		}()
+	}
+}
+
+func TestAppspecApplicationStopMetadata(t *testing.T) {
+	dest := tempTestDir(t)
+	defer os.RemoveAll(dest)
+
+	prevArchive, prevRoot := newTestRevision(t, "previous")
+	defer os.RemoveAll(prevRoot)
+	previous := &appspecRevision{
+		DeploymentID: "1",
+		Appspec:      newTestAppspec(dest, ""),
+		Archive:      prevArchive,
+		Root:         prevRoot,
+	}
+
+	archive, root := newTestRevision(t, "new")
+	defer os.RemoveAll(root)
+
+	if _, err := newTestAppspec(dest, fileExistsOverwrite).Execute(archive, root, log.NewEntry(log.StandardLogger()), "2", map[string]string{"commit": "abc"}, previous); err != nil {
+		t.Fatalf("Deployment failed: %s", err)
+	}
+
+	// The metadata describes the new deployment only
+	for name, expected := range map[string]string{
+		path.Join(prevRoot, "hook-ApplicationStop"): "",
+		path.Join(root, "hook-BeforeInstall"):       "abc",
+		path.Join(root, "hook-AfterInstall"):        "abc",
+	} {
+		if content, err := ioutil.ReadFile(name); err != nil || string(content) != expected {
+			t.Errorf("Expected commit %q in %s, got %q (%v)", expected, name, content, err)
+		}
+	}
+}
+
+func TestAppspecHookCommand(t *testing.T) {
+	root := tempTestDir(t)
+	defer os.RemoveAll(root)
+
+	for name, c := range map[string]struct {
+		content     string
+		mode        os.FileMode
+		interpreter string
+		expected    []string
+		fails       bool
+	}{
+		"interpreter set in appspec": {content: "#!/bin/bash\n", mode: 0755, interpreter: "/usr/bin/env python3", expected: []string{"/usr/bin/env", "python3", "{script}"}},
+		"executable":                 {content: "#!/bin/sh\n", mode: 0755, expected: []string{"{script}"}},
+		"shebang":                    {content: "#!/usr/bin/python3\nprint()\n", mode: 0644, expected: []string{"/usr/bin/python3", "{script}"}},
+		"shebang with argument":      {content: "#! /bin/sh -e -u \n", mode: 0644, expected: []string{"/bin/sh", "-e -u", "{script}"}},
+		"without shebang":            {content: "echo test\n", mode: 0644, expected: []string{hookDefaultInterpreter, "{script}"}},
+		"empty file":                 {mode: 0644, expected: []string{hookDefaultInterpreter, "{script}"}},
+		"empty shebang":              {content: "#!\necho test\n", mode: 0644, fails: true},
+	} {
+		script := path.Join(root, "hook")
+		if err := ioutil.WriteFile(script, []byte(c.content), 0600); err != nil {
+			t.Fatalf("Unable to write script: %s", err)
+		}
+		if err := os.Chmod(script, c.mode); err != nil {
+			t.Fatalf("Unable to set mode: %s", err)
+		}
+
+		argv, err := appspecHook{Location: "hook", Interpreter: c.interpreter}.command(script)
+		if (err != nil) != c.fails {
+			t.Errorf("%s: Unexpected error: %v", name, err)
+			continue
+		}
+
+		expected := strings.Replace(strings.Join(c.expected, "\x00"), "{script}", script, -1)
+		if strings.Join(argv, "\x00") != expected {
+			t.Errorf("%s: Expected command %q, got %q", name, strings.Split(expected, "\x00"), argv)
+		}
+	}
+}
+
+func TestAppspecHookExecute(t *testing.T) {
+	a := newTestTarArchive(t, []testArchiveEntry{
+		{hdr: tar.Header{Name: "no-shebang", Typeflag: tar.TypeReg, Mode: 0755}, content: "touch \"ran-$LIFECYCLE_EVENT\"\n"},
+		{hdr: tar.Header{Name: "shebang.sh", Typeflag: tar.TypeReg, Mode: 0644}, content: "#!/bin/sh -e\ntouch \"ran-$LIFECYCLE_EVENT\"\n"},
+		{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755}},
+	})
+
+	root := tempTestDir(t)
+	defer os.RemoveAll(root)
+	if err := extractArchive(a, root); err != nil {
+		t.Fatalf("Extraction failed: %s", err)
+	}
+
+	logger := log.NewEntry(log.StandardLogger())
+
+	// The executable without shebang is not executable by the kernel and
+	// falls back to bash, the other one is passed to its interpreter
+	for location, event := range map[string]string{"no-shebang": "Fallback", "shebang.sh": "Shebang"} {
+		err := appspecHook{Location: location}.Execute(a, root, logger, map[string]string{"LIFECYCLE_EVENT": event})
+		if err != nil || !fileExists(path.Join(root, "ran-"+event)) {
+			t.Errorf("%s: Script was not executed: %v", location, err)
+		}
+	}
+
+	for _, location := range []string{"missing.sh", "dir"} {
+		if err := (appspecHook{Location: location}).Execute(a, root, logger, nil); err == nil {
+			t.Errorf("%s: Expected error for missing script", location)
+		}
+	}
+}
+
+func TestAppspecPermissions(t *testing.T) {
+	dir := tempTestDir(t)
+	defer os.RemoveAll(dir)
+
+	for name, mode := range map[string]os.FileMode{
+		"a.sh":        0644,
+		"b.txt":       0644,
+		"sub":         os.ModeDir | 0755,
+		"sub/c.sh":    0644,
+		"skip":        os.ModeDir | 0755,
+		"skip/d.sh":   0644,
+		"single.conf": 0644,
+	} {
+		var err error
+		if mode.IsDir() {
+			err = os.Mkdir(path.Join(dir, name), mode.Perm())
+		} else {
+			err = ioutil.WriteFile(path.Join(dir, name), nil, mode.Perm())
+		}
+		if err != nil {
+			t.Fatalf("Unable to create %s: %s", name, err)
+		}
+	}
+	if err := os.Symlink("b.txt", path.Join(dir, "link.sh")); err != nil {
+		t.Fatalf("Unable to create symlink: %s", err)
+	}
+
+	for _, p := range []appspecPermission{
+		{Object: dir, Pattern: "*.sh", Except: []string{"skip"}, Mode: "750", Type: []string{"file"}},
+		{Object: dir, Except: []string{"skip"}, Type: []string{"directory"}, Mode: "2770"},
+		{Object: path.Join(dir, "single.conf"), Mode: "600", Owner: strconv.Itoa(os.Getuid()), Group: strconv.Itoa(os.Getgid())},
+	} {
+		if err := p.Execute(); err != nil {
+			t.Fatalf("Unable to apply permission for %s: %s", p.Object, err)
+		}
+	}
+
+	for name, expected := range map[string]os.FileMode{
+		"a.sh":        0750,
+		"b.txt":       0644,
+		"sub":         os.ModeDir | os.ModeSetgid | 0770,
+		"sub/c.sh":    0750,
+		"skip":        os.ModeDir | 0755,
+		"skip/d.sh":   0644,
+		"single.conf": 0600,
+		"link.sh":     os.ModeSymlink | 0777,
+	} {
+		info, err := os.Lstat(path.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Unable to access %s: %s", name, err)
+		}
+		if info.Mode() != expected {
+			t.Errorf("%s: Expected mode %s, got %s", name, expected, info.Mode())
+		}
+	}
+
+	// The object itself keeps its mode, only the files below it are changed
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Mode of the object was changed: %v (%v)", info.Mode(), err)
+	}
+}
+
+func TestAppspecValidatePermissions(t *testing.T) {
+	for name, p := range map[string]appspecPermission{
+		"relative object":  {Object: "var/www", Mode: "644"},
+		"invalid pattern":  {Object: "/var/www", Pattern: "[", Mode: "644"},
+		"invalid except":   {Object: "/var/www", Except: []string{"["}, Mode: "644"},
+		"invalid type":     {Object: "/var/www", Type: []string{"symlink"}, Mode: "644"},
+		"nothing to apply": {Object: "/var/www"},
+		"invalid mode":     {Object: "/var/www", Mode: "rwx"},
+		"mode too large":   {Object: "/var/www", Mode: "17777"},
+		"unknown owner":    {Object: "/var/www", Owner: "deploy-test-unknown-user"},
+		"unknown group":    {Object: "/var/www", Group: "deploy-test-unknown-group"},
+	} {
+		if err := (appspec{FileExistsBehavior: fileExistsOverwrite, Permissions: []appspecPermission{p}}).Validate(); err == nil {
+			t.Errorf("%s: Invalid permission was accepted", name)
+		}
+	}
+
+	valid := appspecPermission{Object: "/var/www", Pattern: "*.sh", Except: []string{"tmp"}, Owner: "0", Group: "0", Mode: "4755", Type: []string{"file", "directory"}}
+	if err := (appspec{FileExistsBehavior: fileExistsOverwrite, Permissions: []appspecPermission{valid}}).Validate(); err != nil {
+		t.Errorf("Valid permission was refused: %s", err)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	archiveFormatTar     = "tar"
+	archiveFormatTarGzip = "tar.gz"
+	archiveFormatTarZstd = "tar.zst"
+	archiveFormatZIP     = "zip"
+)
+
+var (
+	archiveMagicGzip = []byte{0x1f, 0x8b}
+	archiveMagicTar  = []byte("ustar")
+	archiveMagicZIP  = []byte("PK")
+	archiveMagicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+	// archiveExtensions maps the file extensions to the archive formats,
+	// longer extensions need to be checked first
+	archiveExtensions = []struct{ ext, format string }{
+		{".tar.gz", archiveFormatTarGzip},
+		{".tar.zst", archiveFormatTarZstd},
+		{".tgz", archiveFormatTarGzip},
+		{".tzst", archiveFormatTarZstd},
+		{".tar", archiveFormatTar},
+		{".zip", archiveFormatZIP},
+	}
+)
+
+// deploymentArchive provides access to the files contained in the
+// artifact of a deployment independent of the archive format
+type deploymentArchive interface {
+	// Files returns all entries of the archive in their original order
+	Files() []*archiveFile
+	// Close releases all resources (like temporary files) held by the archive
+	Close() error
+}
+
+// archiveFile is a single entry inside a deploymentArchive
+type archiveFile struct {
+	Name string
+	Mode os.FileMode
+	// Link contains the target of a symbolic link
+	Link string
+	// UID and GID contain the owner of the file if HasOwner is set
+	UID, GID int
+	HasOwner bool
+
+	open func() (io.ReadCloser, error)
+}
+
+// Open returns a reader for the content of the file
+func (a archiveFile) Open() (io.ReadCloser, error) { return a.open() }
+
+// findArchiveFile returns the entry with the given name or nil if the
+// archive does not contain such an entry
+func findArchiveFile(a deploymentArchive, name string) *archiveFile {
+	for _, f := range a.Files() {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// openDeploymentArchive detects the format of the artifact by its magic
+// bytes and falls back to the extension of its name
+func openDeploymentArchive(artifact *deploymentArtifact, name string) (deploymentArchive, error) {
+	format, err := detectArchiveFormat(artifact, name)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case archiveFormatZIP:
+		r, err := zip.NewReader(artifact, artifact.Size)
+		if err != nil {
+			return nil, err
+		}
+		return newZIPArchive(r)
+
+	case archiveFormatTar:
+		return newTarArchive(artifact, nil)
+
+	case archiveFormatTarGzip:
+		return decompressTarArchive(io.NewSectionReader(artifact, 0, artifact.Size), func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		})
+
+	case archiveFormatTarZstd:
+		return decompressTarArchive(io.NewSectionReader(artifact, 0, artifact.Size), func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		})
+	}
+
+	return nil, fmt.Errorf("Unsupported archive format %q", format)
+}
+
+func detectArchiveFormat(artifact *deploymentArtifact, name string) (string, error) {
+	header := make([]byte, 512)
+	n, err := artifact.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("Unable to read archive header: %s", err)
+	}
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, archiveMagicZIP):
+		return archiveFormatZIP, nil
+	case bytes.HasPrefix(header, archiveMagicGzip):
+		return archiveFormatTarGzip, nil
+	case bytes.HasPrefix(header, archiveMagicZstd):
+		return archiveFormatTarZstd, nil
+	case len(header) >= 262 && bytes.Equal(header[257:262], archiveMagicTar):
+		return archiveFormatTar, nil
+	}
+
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(name, e.ext) {
+			return e.format, nil
+		}
+	}
+
+	return "", errors.New("Unable to detect archive format")
+}
+
+// trimArchiveExtension removes a known archive extension from the name
+func trimArchiveExtension(name string) string {
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(name, e.ext) {
+			return strings.TrimSuffix(name, e.ext)
+		}
+	}
+	return name
+}
+
+// extractArchive writes all entries of the archive into the directory.
+// Symlinks are created after all other entries to prevent writing files
+// through them to locations outside of the directory. Symlinks located
+// behind another extracted symlink are refused for the same reason.
+func extractArchive(a deploymentArchive, dir string) error {
+	var links []*archiveFile
+
+	for _, f := range a.Files() {
+		target := path.Join(dir, f.Name)
+
+		switch {
+		case f.Mode.IsDir():
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("Unable to create directory %q: %s", target, err)
+			}
+
+		case f.Mode&os.ModeSymlink != 0:
+			links = append(links, f)
+
+		default:
+			if err := extractArchiveFile(f, target); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range links {
+		if err := checkArchivePathNoSymlink(dir, f.Name); err != nil {
+			return err
+		}
+
+		target := path.Join(dir, f.Name)
+		if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+			return fmt.Errorf("Unable to create directory %q: %s", path.Dir(target), err)
+		}
+		if err := os.Symlink(f.Link, target); err != nil {
+			return fmt.Errorf("Unable to create symlink %q: %s", target, err)
+		}
+	}
+
+	return nil
+}
+
+// checkArchivePathNoSymlink ensures none of the existing parent
+// directories of the entry inside dir is a symlink
+func checkArchivePathNoSymlink(dir, name string) error {
+	parent := dir
+	for _, part := range strings.Split(path.Dir(path.Clean(name)), "/") {
+		if part == "." {
+			break
+		}
+		parent = path.Join(parent, part)
+
+		stat, err := os.Lstat(parent)
+		switch {
+		case os.IsNotExist(err):
+			// Remaining directories are created by the extraction
+			return nil
+		case err != nil:
+			return fmt.Errorf("Unable to stat %q: %s", parent, err)
+		case stat.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("Archive entry %q is located behind the symlink %q", name, strings.TrimPrefix(parent, dir+"/"))
+		}
+	}
+
+	return nil
+}
+
+func extractArchiveFile(f *archiveFile, target string) error {
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return fmt.Errorf("Unable to create directory %q: %s", path.Dir(target), err)
+	}
+
+	fp, err := os.OpenFile(target, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, f.Mode.Perm())
+	if err != nil {
+		return fmt.Errorf("Unable to open %q for writing: %s", target, err)
+	}
+	defer fp.Close()
+
+	afp, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("Unable to read %q from archive: %s", f.Name, err)
+	}
+	defer afp.Close()
+
+	if _, err := io.Copy(fp, afp); err != nil {
+		return fmt.Errorf("Unable to extract %q: %s", f.Name, err)
+	}
+
+	return fp.Close()
+}
+
+// cleanArchivePath normalizes the name of an archive entry and ensures
+// it does not point outside of the archive
+func cleanArchivePath(name string) (string, error) {
+	name = strings.TrimPrefix(name, "./")
+	if name == "" || name == "." {
+		return "", nil
+	}
+
+	isDir := strings.HasSuffix(name, "/")
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("Archive entry %q points outside of the archive", name)
+	}
+
+	if isDir {
+		clean += "/"
+	}
+	return clean, nil
+}
+
+type zipArchive struct {
+	files []*archiveFile
+}
+
+func newZIPArchive(r *zip.Reader) (*zipArchive, error) {
+	a := &zipArchive{}
+
+	for _, f := range r.File {
+		name, err := cleanArchivePath(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+
+		af := &archiveFile{Name: name, Mode: f.Mode(), open: f.Open}
+
+		if af.Mode&os.ModeSymlink != 0 {
+			// ZIP stores the target of symlinks as file content
+			if af.Link, err = readZIPLink(f); err != nil {
+				return nil, err
+			}
+		}
+
+		a.files = append(a.files, af)
+	}
+
+	return a, nil
+}
+
+func (z zipArchive) Files() []*archiveFile { return z.files }
+func (z zipArchive) Close() error          { return nil }
+
+func readZIPLink(f *zip.File) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", fmt.Errorf("Unable to read link target of %q: %s", f.Name, err)
+	}
+	defer r.Close()
+
+	target, err := ioutil.ReadAll(io.LimitReader(r, 4096))
+	return string(target), err
+}
+
+// tarArchive indexes the entries of an uncompressed tar file and reads
+// their content directly from the underlying file
+type tarArchive struct {
+	files []*archiveFile
+
+	// temporary is removed when closing the archive
+	temporary *os.File
+}
+
+func newTarArchive(r io.ReaderAt, temporary *os.File) (*tarArchive, error) {
+	var (
+		a       = &tarArchive{temporary: temporary}
+		counter = &countingReader{r: io.NewSectionReader(r, 0, 1<<62)}
+		tr      = tar.NewReader(counter)
+		byName  = map[string]*archiveFile{}
+	)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read tar header: %s", err)
+		}
+
+		name, err := cleanArchivePath(hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			continue
+		}
+
+		af := &archiveFile{
+			Name:     name,
+			Mode:     hdr.FileInfo().Mode(),
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			HasOwner: true,
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// Content is located directly behind the header
+			offset, size := counter.n, hdr.Size
+			af.open = func() (io.ReadCloser, error) {
+				return ioutil.NopCloser(io.NewSectionReader(r, offset, size)), nil
+			}
+
+		case tar.TypeLink:
+			target, err := cleanArchivePath(hdr.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			if byName[target] == nil || byName[target].open == nil {
+				return nil, fmt.Errorf("Hard link %q points to unknown file %q", name, hdr.Linkname)
+			}
+			af.Mode = byName[target].Mode
+			af.open = byName[target].open
+
+		case tar.TypeSymlink:
+			af.Link = hdr.Linkname
+
+		case tar.TypeDir:
+			// Nothing to read
+
+		case tar.TypeGNUSparse:
+			return nil, fmt.Errorf("Sparse file %q is not supported", name)
+
+		default:
+			// Devices, FIFOs, ... are not part of deployments
+			continue
+		}
+
+		byName[name] = af
+		a.files = append(a.files, af)
+	}
+
+	return a, nil
+}
+
+// decompressTarArchive decompresses the artifact into a temporary file
+// to allow random access to the contained files
+func decompressTarArchive(artifact io.Reader, decompressor func(io.Reader) (io.Reader, error)) (*tarArchive, error) {
+	tmp, err := ioutil.TempFile(cfg.TempDir, "deploy-archive-")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create temporary file: %s", err)
+	}
+
+	a, err := func() (*tarArchive, error) {
+		r, err := decompressor(artifact)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to initialize decompression: %s", err)
+		}
+		if c, ok := r.(interface{ Close() }); ok {
+			defer c.Close()
+		}
+
+		if _, err := io.Copy(tmp, r); err != nil {
+			return nil, fmt.Errorf("Unable to decompress archive: %s", err)
+		}
+
+		return newTarArchive(tmp, tmp)
+	}()
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (t tarArchive) Files() []*archiveFile { return t.files }
+
+func (t tarArchive) Close() error {
+	if t.temporary == nil {
+		return nil
+	}
+
+	t.temporary.Close()
+	return os.Remove(t.temporary.Name())
+}
+
+// countingReader keeps track of the number of bytes read
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
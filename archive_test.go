@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testArchiveEntry struct {
+	hdr     tar.Header
+	content string
+}
+
+func newTestTarArchive(t *testing.T, entries []testArchiveEntry) *tarArchive {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+	for _, e := range entries {
+		hdr := e.hdr
+		hdr.Size = int64(len(e.content))
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatalf("Unable to write header of %s: %s", hdr.Name, err)
+		}
+		if _, err := w.Write([]byte(e.content)); err != nil {
+			t.Fatalf("Unable to write %s: %s", hdr.Name, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Unable to close archive: %s", err)
+	}
+
+	a, err := newTarArchive(bytes.NewReader(buf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("Unable to read archive: %s", err)
+	}
+	return a
+}
+
+func tempTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "deploy-archive-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	return dir
+}
+
+func TestExtractArchive(t *testing.T) {
+	dir := tempTestDir(t)
+	defer os.RemoveAll(dir)
+
+	a := newTestTarArchive(t, []testArchiveEntry{
+		{hdr: tar.Header{Name: "current", Typeflag: tar.TypeSymlink, Linkname: "app/run.sh", Mode: 0777}},
+		{hdr: tar.Header{Name: "app/", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "app/run.sh", Typeflag: tar.TypeReg, Mode: 0750}, content: "#!/bin/sh\n"},
+		{hdr: tar.Header{Name: "app/start.sh", Typeflag: tar.TypeLink, Linkname: "app/run.sh"}},
+	})
+
+	if err := extractArchive(a, dir); err != nil {
+		t.Fatalf("Extraction failed: %s", err)
+	}
+
+	for _, name := range []string{"app/run.sh", "app/start.sh", "current"} {
+		content, err := ioutil.ReadFile(path.Join(dir, name))
+		if err != nil || string(content) != "#!/bin/sh\n" {
+			t.Errorf("Unexpected content of %s: %q (%v)", name, content, err)
+		}
+	}
+
+	if stat, err := os.Stat(path.Join(dir, "app/start.sh")); err != nil || stat.Mode().Perm() != 0750 {
+		t.Errorf("Hard link does not have the mode of its target: %v (%v)", stat.Mode(), err)
+	}
+
+	if link, err := os.Readlink(path.Join(dir, "current")); err != nil || link != "app/run.sh" {
+		t.Errorf("Unexpected symlink target %q (%v)", link, err)
+	}
+}
+
+func TestExtractArchiveRefusesEntriesBehindSymlinks(t *testing.T) {
+	outside := tempTestDir(t)
+	defer os.RemoveAll(outside)
+
+	for name, entries := range map[string][]testArchiveEntry{
+		"symlink": {
+			{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777}},
+			{hdr: tar.Header{Name: "a/x", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0777}},
+		},
+		"nested symlink": {
+			{hdr: tar.Header{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777}},
+			{hdr: tar.Header{Name: "a/b/c/x", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd", Mode: 0777}},
+		},
+		"file": {
+			{hdr: tar.Header{Name: "a", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777}},
+			{hdr: tar.Header{Name: "a/x", Typeflag: tar.TypeReg, Mode: 0644}, content: "x"},
+		},
+	} {
+		dir := tempTestDir(t)
+
+		if err := extractArchive(newTestTarArchive(t, entries), dir); err == nil {
+			t.Errorf("%s: Extraction of entry behind symlink succeeded", name)
+		}
+
+		files, _ := ioutil.ReadDir(outside)
+		for _, f := range files {
+			t.Errorf("%s: File %s was created outside of the directory", name, f.Name())
+			os.RemoveAll(path.Join(outside, f.Name()))
+		}
+
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCleanArchivePath(t *testing.T) {
+	for name, expected := range map[string]string{
+		"./":            "",
+		"./app/run.sh":  "app/run.sh",
+		"app//run.sh":   "app/run.sh",
+		"app/./bin/":    "app/bin/",
+		"app/../run.sh": "run.sh",
+	} {
+		if clean, err := cleanArchivePath(name); err != nil || clean != expected {
+			t.Errorf("Expected %q for %q, got %q (%v)", expected, name, clean, err)
+		}
+	}
+
+	for _, name := range []string{"/etc/passwd", "../run.sh", "app/../../run.sh", ".."} {
+		if clean, err := cleanArchivePath(name); err == nil {
+			t.Errorf("Path %q outside of the archive was accepted as %q", name, clean)
+		}
+	}
+}
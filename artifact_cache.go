@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// artifactCache keeps downloaded artifacts on disk to reuse them for
+// retries, restarts and rollbacks. Entries are keyed by the identifier,
+// the deployment ID and the version reported by the storage provider
+// and verified against their recorded checksum before being reused. The
+// artifacts keep the extension of their name inside the storage.
+type artifactCache struct {
+	dir     string
+	maxSize int64
+}
+
+type artifactCacheEntry struct {
+	Identifier   string `json:"identifier"`
+	DeploymentID string `json:"deployment_id"`
+	Version      string `json:"version"`
+	Extension    string `json:"extension"`
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256"`
+}
+
+func newArtifactCache(dir string, maxSize int64) (*artifactCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("Unable to create cache directory: %s", err)
+	}
+
+	return &artifactCache{dir: dir, maxSize: maxSize}, nil
+}
+
+// Get returns the cached artifact for the given key or nil if it is not
+// cached. Entries failing the integrity check are removed from the cache.
+func (a artifactCache) Get(identifier, deploymentID, version string) (*os.File, int64, error) {
+	key := a.key(identifier, deploymentID, version)
+
+	rawEntry, err := ioutil.ReadFile(a.metaFile(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+
+	entry := artifactCacheEntry{}
+	if err := json.Unmarshal(rawEntry, &entry); err != nil {
+		return nil, 0, a.remove(key)
+	}
+
+	f, err := os.Open(a.dataFile(key, entry.Extension))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, 0, a.remove(key)
+		}
+		return nil, 0, err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	if size != entry.Size || hex.EncodeToString(hash.Sum(nil)) != entry.SHA256 {
+		f.Close()
+		return nil, 0, a.remove(key)
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	// Mark entry as recently used for the eviction
+	now := time.Now()
+	os.Chtimes(a.metaFile(key), now, now)
+
+	return f, size, nil
+}
+
+// Store fetches the artifact into the cache using the given extension,
+// records its checksum and returns the cached file
+func (a artifactCache) Store(identifier, deploymentID, version, extension string, fetch func(io.Writer) error) (*os.File, int64, error) {
+	key := a.key(identifier, deploymentID, version)
+
+	// Replace a previous entry of the key (possibly stored with another
+	// extension) instead of leaving its file behind
+	if err := a.remove(key); err != nil {
+		return nil, 0, fmt.Errorf("Unable to replace cache entry: %s", err)
+	}
+
+	tmp, err := ioutil.TempFile(a.dir, "incoming-")
+	if err != nil {
+		return nil, 0, fmt.Errorf("Unable to create cache file: %s", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	if err := fetch(io.MultiWriter(tmp, hash)); err != nil {
+		tmp.Close()
+		return nil, 0, err
+	}
+
+	stat, err := tmp.Stat()
+	if err != nil {
+		tmp.Close()
+		return nil, 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return nil, 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), a.dataFile(key, extension)); err != nil {
+		return nil, 0, fmt.Errorf("Unable to move artifact into cache: %s", err)
+	}
+
+	rawEntry, err := json.Marshal(artifactCacheEntry{
+		Identifier:   identifier,
+		DeploymentID: deploymentID,
+		Version:      version,
+		Extension:    extension,
+		Size:         stat.Size(),
+		SHA256:       hex.EncodeToString(hash.Sum(nil)),
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := ioutil.WriteFile(a.metaFile(key), rawEntry, 0600); err != nil {
+		return nil, 0, fmt.Errorf("Unable to write cache entry: %s", err)
+	}
+
+	f, err := os.Open(a.dataFile(key, extension))
+	return f, stat.Size(), err
+}
+
+// Remove deletes the entry for the given key from the cache
+func (a artifactCache) Remove(identifier, deploymentID, version string) error {
+	return a.remove(a.key(identifier, deploymentID, version))
+}
+
+// Evict removes the least recently used entries except the entry of the
+// given key until the cache size is below the configured maximum. Files
+// opened before stay readable even when their entry is evicted.
+func (a artifactCache) Evict(identifier, deploymentID, version string) error {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries   []os.FileInfo
+		sizes     = map[string]int64{}
+		totalSize int64
+	)
+
+	for _, f := range files {
+		key, ext := a.splitName(f.Name())
+		switch {
+		case strings.HasPrefix(f.Name(), "incoming-"):
+		case ext == ".json":
+			entries = append(entries, f)
+		default:
+			sizes[key] += f.Size()
+			totalSize += f.Size()
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	current := a.key(identifier, deploymentID, version)
+	for _, e := range entries {
+		if totalSize <= a.maxSize {
+			break
+		}
+
+		key, _ := a.splitName(e.Name())
+		if key == current {
+			continue
+		}
+
+		if err := a.remove(key); err != nil {
+			return err
+		}
+		totalSize -= sizes[key]
+	}
+
+	return nil
+}
+
+// remove deletes the metadata and the artifact of the key independent
+// of the extension the artifact was stored with
+func (a artifactCache) remove(key string) error {
+	files, err := ioutil.ReadDir(a.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if k, _ := a.splitName(f.Name()); k != key {
+			continue
+		}
+		if err := os.Remove(path.Join(a.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitName splits the name of a file inside the cache into the key and
+// the extension
+func (a artifactCache) splitName(name string) (string, string) {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[:i], name[i:]
+	}
+	return name, ""
+}
+
+func (a artifactCache) key(identifier, deploymentID, version string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{identifier, deploymentID, version}, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+func (a artifactCache) dataFile(key, extension string) string { return path.Join(a.dir, key+extension) }
+func (a artifactCache) metaFile(key string) string            { return path.Join(a.dir, key+".json") }
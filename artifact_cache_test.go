@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func readTestCache(t *testing.T, identifier, deploymentID, version string) string {
+	f, _, err := artifactStore.Get(identifier, deploymentID, version)
+	if err != nil {
+		t.Fatalf("Unable to read cache: %s", err)
+	}
+	if f == nil {
+		return ""
+	}
+	defer f.Close()
+
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Unable to read cached artifact: %s", err)
+	}
+	return string(content)
+}
+
+func TestArtifactCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-cache-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(naming artifactNameTemplate) { artifactNaming = naming }(artifactNaming)
+	if artifactNaming, err = newArtifactNameTemplate("{identifier}/{id}.tar.gz", ""); err != nil {
+		t.Fatalf("Unable to parse template: %s", err)
+	}
+
+	if artifactStore, err = newArtifactCache(dir, 10); err != nil {
+		t.Fatalf("Unable to create cache: %s", err)
+	}
+	defer func() { artifactStore = nil }()
+
+	s := &fakeStorage{name: "v1", artifacts: map[string]string{
+		"1": "first",
+		"2": "second",
+		"3": "larger than the cache",
+	}}
+	logger := log.NewEntry(log.StandardLogger())
+
+	// Together the first two artifacts exceed the maximum size so the
+	// older one is evicted, the third one is kept even though it exceeds
+	// the maximum size on its own
+	for _, deploymentID := range []string{"1", "2", "3"} {
+		artifact, err := fetchArtifact(s, "default", deploymentID, logger)
+		if err != nil {
+			t.Fatalf("Unable to fetch %s: %s", deploymentID, err)
+		}
+		artifact.Close()
+
+		for id, content := range s.artifacts {
+			if id != deploymentID {
+				content = ""
+			}
+			if cached := readTestCache(t, "default", id, "v1"); cached != content {
+				t.Errorf("After fetching %s: Expected cached artifact %s to be %q, got %q", deploymentID, id, content, cached)
+			}
+		}
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unable to list cache: %s", err)
+	}
+	if len(files) != 2 {
+		t.Errorf("Expected the files of one entry, got %d files", len(files))
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") && !strings.HasSuffix(f.Name(), ".tar.gz") {
+			t.Errorf("Artifact %s was not stored with its extension", f.Name())
+		}
+	}
+
+	// Storing the entry again with another extension replaces it
+	f, _, err := artifactStore.Store("default", "3", "v1", ".zip", func(w io.Writer) error {
+		_, err := io.WriteString(w, "replaced")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Unable to store artifact: %s", err)
+	}
+	f.Close()
+
+	if got := readTestCache(t, "default", "3", "v1"); got != "replaced" {
+		t.Errorf("Expected replaced artifact, got %q", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz")); len(matches) != 0 {
+		t.Errorf("Replaced artifact was kept: %v", matches)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+const checksumSuffix = ".sha256"
+
+// artifactChecksums contains the checksums of an artifact known to the
+// storage provider. Unknown checksums are left empty.
+type artifactChecksums struct {
+	Size   int64
+	MD5    []byte
+	CRC32C []byte
+	SHA256 []byte
+}
+
+// checksumMismatchError is returned when the downloaded artifact does not
+// match the checksums known for it
+type checksumMismatchError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (c checksumMismatchError) Error() string {
+	return fmt.Sprintf("Artifact checksum mismatch: %s expected %s, got %s", c.Algorithm, c.Expected, c.Actual)
+}
+
+// crc32cChecksum encodes a CRC32C checksum in big-endian byte order
+func crc32cChecksum(sum uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, sum)
+}
+
+// verifyArtifactChecksums checks the artifact against the checksums
+// reported by the storage provider and the `.sha256` sidecar object if
+// one exists next to the artifact
+func verifyArtifactChecksums(s storageProvider, identifier, deploymentID string, artifact *deploymentArtifact) error {
+	expected, err := s.GetDeploymentArtifactChecksums(identifier, deploymentID)
+	if err != nil {
+		return fmt.Errorf("Unable to get artifact checksums: %s", err)
+	}
+
+	sidecar, err := fetchChecksumSidecar(s, artifactNaming.Name(identifier, deploymentID)+checksumSuffix)
+	if err != nil {
+		return err
+	}
+
+	if expected.Size > 0 && expected.Size != artifact.Size {
+		return checksumMismatchError{
+			Algorithm: "size",
+			Expected:  fmt.Sprintf("%d", expected.Size),
+			Actual:    fmt.Sprintf("%d", artifact.Size),
+		}
+	}
+
+	var (
+		md5Hash    = md5.New()
+		crc32cHash = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		sha256Hash = sha256.New()
+	)
+
+	if _, err := io.Copy(io.MultiWriter(md5Hash, crc32cHash, sha256Hash), io.NewSectionReader(artifact, 0, artifact.Size)); err != nil {
+		return fmt.Errorf("Unable to calculate artifact checksums: %s", err)
+	}
+
+	for _, c := range []struct {
+		algorithm string
+		expected  []byte
+		actual    hash.Hash
+	}{
+		{"MD5", expected.MD5, md5Hash},
+		{"CRC32C", expected.CRC32C, crc32cHash},
+		{"SHA256", expected.SHA256, sha256Hash},
+		{"SHA256 (" + checksumSuffix + ")", sidecar, sha256Hash},
+	} {
+		if c.expected == nil {
+			continue
+		}
+
+		if actual := c.actual.Sum(nil); !bytes.Equal(actual, c.expected) {
+			return checksumMismatchError{
+				Algorithm: c.algorithm,
+				Expected:  hex.EncodeToString(c.expected),
+				Actual:    hex.EncodeToString(actual),
+			}
+		}
+	}
+
+	return nil
+}
+
+// fetchChecksumSidecar reads the SHA256 checksum from the sidecar object
+// in the format written by `sha256sum`. If there is no sidecar nil is
+// returned.
+func fetchChecksumSidecar(s storageProvider, name string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := s.GetObject(name, buf); err != nil {
+		if err == errNoSuchObject {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to fetch checksum %q: %s", name, err)
+	}
+
+	fields := strings.Fields(buf.String())
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("Checksum %q is empty", name)
+	}
+
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("Checksum %q does not contain a valid SHA256 checksum", name)
+	}
+
+	return sum, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// truncatingStorage reports the checksums of the complete artifact while
+// serving a truncated one
+type truncatingStorage struct {
+	*fakeStorage
+}
+
+func (t truncatingStorage) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	return artifactChecksums{Size: int64(len(t.artifacts[deploymentID]) + 1)}, nil
+}
+
+func TestFetchArtifactChecksumMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-cache-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if artifactStore, err = newArtifactCache(dir, 1024); err != nil {
+		t.Fatalf("Unable to create cache: %s", err)
+	}
+	defer func() { artifactStore = nil }()
+
+	s := truncatingStorage{&fakeStorage{name: "v1", artifacts: map[string]string{"1": "truncated"}}}
+
+	_, err = fetchArtifact(s, "default", "1", log.NewEntry(log.StandardLogger()))
+	if mismatch, ok := err.(checksumMismatchError); !ok || mismatch.Algorithm != "size" {
+		t.Fatalf("Expected size mismatch, got %v", err)
+	}
+
+	f, _, err := artifactStore.Get("default", "1", "v1")
+	if err != nil {
+		t.Fatalf("Unable to read cache: %s", err)
+	}
+	if f != nil {
+		f.Close()
+		t.Error("Mismatching artifact was kept in the cache")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// runCommand executes the given command against the storage instead of
+// starting the deployment loop
+func runCommand(storage storageProvider, args []string) error {
+	switch args[0] {
+	case "set-latest":
+		if len(args) != 2 {
+			return fmt.Errorf("Usage: set-latest <deployment-id>")
+		}
+		return setLatestPointer(storage, cfg.SoftwareIdentifier, args[1])
+
+	case "clear-latest":
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: clear-latest")
+		}
+		return clearLatestPointer(storage, cfg.SoftwareIdentifier)
+
+	case "pin":
+		if len(args) != 2 {
+			return fmt.Errorf("Usage: pin <deployment-id>")
+		}
+		return setPin(storage, cfg.SoftwareIdentifier, args[1])
+
+	case "unpin":
+		if len(args) != 1 {
+			return fmt.Errorf("Usage: unpin")
+		}
+		return clearPin(storage, cfg.SoftwareIdentifier)
+
+	default:
+		return fmt.Errorf("Unknown command %q", args[0])
+	}
+}
+
+// setLatestPointer marks the given deployment as the latest one for the
+// identifier after ensuring the deployment exists
+func setLatestPointer(storage storageProvider, identifier, deploymentID string) error {
+	if err := validateDeploymentID(deploymentID); err != nil {
+		return err
+	}
+
+	if _, err := storage.GetDeploymentArtifactVersion(identifier, deploymentID); err != nil {
+		return fmt.Errorf("Unable to verify deployment %q: %s", deploymentID, err)
+	}
+
+	if err := storage.PutObject(identifier+latestPointerSuffix, []byte(deploymentID+"\n")); err != nil {
+		return fmt.Errorf("Unable to write latest pointer: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"identifier":    identifier,
+	}).Info("Latest pointer updated")
+
+	return nil
+}
+
+// clearLatestPointer removes the latest pointer for the identifier so
+// the latest deployment is detected by the storage provider again
+func clearLatestPointer(storage storageProvider, identifier string) error {
+	if err := storage.DeleteObject(identifier + latestPointerSuffix); err != nil {
+		return fmt.Errorf("Unable to remove latest pointer: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"identifier": identifier,
+	}).Info("Latest pointer removed")
+
+	return nil
+}
+
+// setPin stores the pin object for the identifier after ensuring the
+// deployment exists so all hosts stay on that deployment
+func setPin(storage storageProvider, identifier, deploymentID string) error {
+	if err := validateDeploymentID(deploymentID); err != nil {
+		return err
+	}
+
+	if _, err := storage.GetDeploymentArtifactVersion(identifier, deploymentID); err != nil {
+		return fmt.Errorf("Unable to verify deployment %q: %s", deploymentID, err)
+	}
+
+	if err := storage.PutObject(identifier+pinSuffix, []byte(deploymentID+"\n")); err != nil {
+		return fmt.Errorf("Unable to write pin: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"deployment_id": deploymentID,
+		"identifier":    identifier,
+	}).Info("Deployment pinned")
+
+	return nil
+}
+
+// clearPin removes the pin object for the identifier so the hosts
+// follow the latest deployment again
+func clearPin(storage storageProvider, identifier string) error {
+	if err := storage.DeleteObject(identifier + pinSuffix); err != nil {
+		return fmt.Errorf("Unable to remove pin: %s", err)
+	}
+
+	log.WithFields(log.Fields{
+		"identifier": identifier,
+	}).Info("Deployment unpinned")
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	encryptionAge    = "age"
+	encryptionAESGCM = "aes-256-gcm"
+
+	aesGCMSuffix = ".enc"
+	ageSuffix    = ".age"
+	aesKeySize   = 32
+
+	// ageMagic is the first line of every binary age encrypted file
+	ageMagic = "age-encryption.org/v1"
+
+	// AES-256-GCM artifacts are decrypted in memory so their size is limited
+	aesGCMMaxSize = 256 << 20
+)
+
+// decryptionKeySet contains the locally held keys to decrypt encrypted
+// artifacts with
+type decryptionKeySet struct {
+	AgeIdentities []age.Identity
+	AESKeys       [][]byte
+}
+
+// loadDecryptionKeys reads the given key files which either contain age
+// identities or an AES-256 key (raw, hex or base64 encoded)
+func loadDecryptionKeys(files []string) (decryptionKeySet, error) {
+	var keys decryptionKeySet
+
+	for _, fn := range files {
+		if fn == "" {
+			continue
+		}
+
+		raw, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return keys, fmt.Errorf("Unable to read key file %q: %s", fn, err)
+		}
+
+		if bytes.Contains(raw, []byte("AGE-SECRET-KEY-")) {
+			ids, err := age.ParseIdentities(bytes.NewReader(raw))
+			if err != nil {
+				return keys, fmt.Errorf("Unable to parse age identities from %q: %s", fn, err)
+			}
+			keys.AgeIdentities = append(keys.AgeIdentities, ids...)
+			continue
+		}
+
+		key, err := parseAESKey(raw)
+		if err != nil {
+			return keys, fmt.Errorf("Unable to parse AES key from %q: %s", fn, err)
+		}
+		keys.AESKeys = append(keys.AESKeys, key)
+	}
+
+	return keys, nil
+}
+
+func parseAESKey(raw []byte) ([]byte, error) {
+	if len(raw) == aesKeySize {
+		return raw, nil
+	}
+
+	enc := strings.TrimSpace(string(raw))
+	if key, err := hex.DecodeString(enc); err == nil && len(key) == aesKeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(enc); err == nil && len(key) == aesKeySize {
+		return key, nil
+	}
+
+	return nil, errors.New("Key file must contain 32 bytes (raw, hex or base64 encoded)")
+}
+
+// decryptArtifact detects whether the artifact is encrypted and decrypts
+// it into a temporary file. Unencrypted artifacts are returned unchanged.
+// The returned name has the encryption extension removed to be used for
+// archive format detection.
+func decryptArtifact(artifact *deploymentArtifact, name string, logger *log.Entry) (*deploymentArtifact, string, error) {
+	header := make([]byte, len(ageMagic)+1)
+	n, err := artifact.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return nil, "", fmt.Errorf("Unable to read artifact header: %s", err)
+	}
+
+	var (
+		encryption string
+		decrypt    func(io.Writer) error
+	)
+
+	switch {
+	case string(header[:n]) == ageMagic+"\n":
+		if len(decryptionKeys.AgeIdentities) == 0 {
+			return nil, "", errors.New("Artifact is encrypted using age but no age identity is configured")
+		}
+
+		encryption = encryptionAge
+		decrypt = func(w io.Writer) error { return decryptAge(w, artifact, decryptionKeys.AgeIdentities) }
+
+	case strings.HasSuffix(name, aesGCMSuffix):
+		if len(decryptionKeys.AESKeys) == 0 {
+			return nil, "", errors.New("Artifact is encrypted using AES-256-GCM but no AES key is configured")
+		}
+
+		encryption = encryptionAESGCM
+		decrypt = func(w io.Writer) error { return decryptAESGCM(w, artifact, decryptionKeys.AESKeys) }
+
+	default:
+		return artifact, name, nil
+	}
+
+	f, err := ioutil.TempFile(cfg.TempDir, "deploy-decrypted-")
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to create temporary file: %s", err)
+	}
+
+	decrypted := &deploymentArtifact{File: f, temporary: true}
+
+	if err := decrypt(f); err != nil {
+		decrypted.Close()
+		return nil, "", err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		decrypted.Close()
+		return nil, "", err
+	}
+	decrypted.Size = stat.Size()
+
+	logger.WithFields(log.Fields{
+		"encryption": encryption,
+		"size":       decrypted.Size,
+	}).Debug("Artifact decrypted")
+
+	return decrypted, strings.TrimSuffix(strings.TrimSuffix(name, ageSuffix), aesGCMSuffix), nil
+}
+
+// decryptAge decrypts the artifact while streaming it into dst, the
+// payload is authenticated in chunks of 64 KiB
+func decryptAge(dst io.Writer, artifact *deploymentArtifact, identities []age.Identity) error {
+	r, err := age.Decrypt(io.NewSectionReader(artifact, 0, artifact.Size), identities...)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt artifact using age: %s", err)
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		return fmt.Errorf("Unable to decrypt artifact using age: %s", err)
+	}
+	return nil
+}
+
+// decryptAESGCM decrypts an artifact consisting of a 12 byte nonce
+// followed by the ciphertext and the authentication tag. As GCM needs the
+// whole message to authenticate it the artifact is read into memory and
+// artifacts larger than aesGCMMaxSize are refused.
+func decryptAESGCM(dst io.Writer, artifact *deploymentArtifact, keys [][]byte) error {
+	if artifact.Size > aesGCMMaxSize {
+		return fmt.Errorf("Artifact exceeds the maximum size of %d MiB for AES-256-GCM, use age for larger artifacts", aesGCMMaxSize>>20)
+	}
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(artifact, 0, artifact.Size))
+	if err != nil {
+		return fmt.Errorf("Unable to read artifact: %s", err)
+	}
+
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+
+		if len(data) < gcm.NonceSize()+gcm.Overhead() {
+			return errors.New("Artifact is too short to be encrypted using AES-256-GCM")
+		}
+
+		plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+		if err != nil {
+			// Wrong key or modified artifact, try the next key
+			continue
+		}
+
+		_, err = dst.Write(plain)
+		return err
+	}
+
+	return errors.New("Artifact could not be decrypted with any of the configured AES keys")
+}
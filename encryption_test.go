@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The files in testdata/age were created by the age CLI (v1.2.0):
+//
+//	age-keygen -o key.txt
+//	age -r <recipient of key.txt> -o small.txt.age
+//	age -r <recipient of key.txt> -o large.bin.age large.bin
+//	age -r <other recipient> -o other.txt.age
+
+func openTestArtifact(t *testing.T, name string, content []byte) *deploymentArtifact {
+	f, err := ioutil.TempFile("", "deploy-encryption-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary file: %s", err)
+	}
+	if _, err := f.Write(content); err != nil {
+		t.Fatalf("Unable to write %s: %s", name, err)
+	}
+	return &deploymentArtifact{File: f, Size: int64(len(content)), temporary: true}
+}
+
+func decryptTestArtifact(t *testing.T, name string, content []byte) ([]byte, string, error) {
+	artifact := openTestArtifact(t, name, content)
+	defer artifact.Close()
+
+	decrypted, decryptedName, err := decryptArtifact(artifact, name, log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		return nil, "", err
+	}
+	defer decrypted.Close()
+
+	plain, err := ioutil.ReadAll(io.NewSectionReader(decrypted, 0, decrypted.Size))
+	return plain, decryptedName, err
+}
+
+func TestDecryptArtifactAge(t *testing.T) {
+	defer func(keys decryptionKeySet) { decryptionKeys = keys }(decryptionKeys)
+
+	var err error
+	if decryptionKeys, err = loadDecryptionKeys([]string{"testdata/age/key.txt"}); err != nil {
+		t.Fatalf("Unable to load identity: %s", err)
+	}
+	if len(decryptionKeys.AgeIdentities) != 1 {
+		t.Fatalf("Expected one age identity, got %d", len(decryptionKeys.AgeIdentities))
+	}
+
+	// Two chunks, the second one not filled completely
+	large := make([]byte, 70000)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+
+	for name, expected := range map[string][]byte{
+		"small.txt.age": []byte("deploy test artifact\n"),
+		"large.bin.age": large,
+	} {
+		raw, err := ioutil.ReadFile(path.Join("testdata/age", name))
+		if err != nil {
+			t.Fatalf("Unable to read fixture: %s", err)
+		}
+
+		plain, plainName, err := decryptTestArtifact(t, name, raw)
+		if err != nil {
+			t.Errorf("%s: Unable to decrypt: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(plain, expected) {
+			t.Errorf("%s: Plaintext does not match (%d bytes)", name, len(plain))
+		}
+		if plainName != name[:len(name)-len(ageSuffix)] {
+			t.Errorf("%s: Unexpected name %q", name, plainName)
+		}
+	}
+
+	raw, err := ioutil.ReadFile("testdata/age/large.bin.age")
+	if err != nil {
+		t.Fatalf("Unable to read fixture: %s", err)
+	}
+	other, err := ioutil.ReadFile("testdata/age/other.txt.age")
+	if err != nil {
+		t.Fatalf("Unable to read fixture: %s", err)
+	}
+
+	for name, content := range map[string][]byte{
+		"other recipient": other,
+		"flipped":         append(append([]byte{}, raw[:len(raw)-1]...), raw[len(raw)-1]^1),
+		"truncated":       raw[:len(raw)-100],
+	} {
+		if _, _, err := decryptTestArtifact(t, "default1.zip.age", content); err == nil {
+			t.Errorf("%s: Artifact was not rejected", name)
+		}
+	}
+}
+
+func TestDecryptArtifactAESGCM(t *testing.T) {
+	defer func(keys decryptionKeySet) { decryptionKeys = keys }(decryptionKeys)
+
+	key := make([]byte, aesKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Unable to generate key: %s", err)
+	}
+
+	keyFile := path.Join(os.TempDir(), "deploy-encryption-test.key")
+	if err := ioutil.WriteFile(keyFile, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+		t.Fatalf("Unable to write key: %s", err)
+	}
+	defer os.Remove(keyFile)
+
+	var err error
+	if decryptionKeys, err = loadDecryptionKeys([]string{keyFile}); err != nil {
+		t.Fatalf("Unable to load key: %s", err)
+	}
+
+	block, _ := aes.NewCipher(key)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	encrypted := gcm.Seal(nonce, nonce, []byte("deploy test artifact\n"), nil)
+
+	plain, name, err := decryptTestArtifact(t, "default1.zip.enc", encrypted)
+	if err != nil || string(plain) != "deploy test artifact\n" || name != "default1.zip" {
+		t.Errorf("Unexpected result %q / %q (%v)", plain, name, err)
+	}
+
+	encrypted[len(encrypted)-1] ^= 1
+	if _, _, err := decryptTestArtifact(t, "default1.zip.enc", encrypted); err == nil {
+		t.Error("Modified artifact was not rejected")
+	}
+
+	// Unencrypted artifacts are passed through
+	if plain, name, err := decryptTestArtifact(t, "default1.zip", []byte("PK")); err != nil || string(plain) != "PK" || name != "default1.zip" {
+		t.Errorf("Unexpected result for unencrypted artifact %q / %q (%v)", plain, name, err)
+	}
+}
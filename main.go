@@ -1,10 +1,13 @@
 package main
 
 import (
-	"archive/zip"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
+	"time"
 
+	"aead.dev/minisign"
 	"github.com/Luzifer/rconfig"
 	"github.com/contentflow/deploy/bufferhook"
 	"github.com/robfig/cron"
@@ -13,20 +16,45 @@ import (
 
 var (
 	cfg = struct {
-		FetchCron          string   `flag:"fetch-cron,c" default:"* * * * *" description:"When to query for new deployments (cron syntax)"`
-		LogLevel           string   `flag:"log-level" default:"info" description:"Log level (debug, info, warn, error, fatal)"`
-		Reporters          []string `flag:"reporter,r" default:"" description:"Reporting URIs to notify about deployments"`
-		SoftwareIdentifier string   `flag:"identifier,i" default:"default" description:"Software identifier to query deployments for"`
-		StorageURI         string   `flag:"storage,s" default:"" description:"URI for the storage provider to use" validate:"nonzero"`
-		VersionAndExit     bool     `flag:"version" default:"false" description:"Prints current version and exits"`
+		ArtifactIDPattern  string        `flag:"artifact-id-pattern" default:"" description:"Regular expression deployment IDs inside artifact names must match (Default: any valid ID)"`
+		ArtifactName       string        `flag:"artifact-name" default:"{identifier}{id}.zip" description:"Template for artifact names inside the storage ({identifier}, {id})"`
+		CacheDir           string        `flag:"cache-dir" default:"" description:"Directory to cache downloaded artifacts in (Default: cache disabled)"`
+		CacheSize          int64         `flag:"cache-size" default:"1024" description:"Maximum size of the artifact cache in MiB"`
+		DecryptionKeys     []string      `flag:"decryption-key" default:"" description:"Key files (age identities or AES-256 keys) to decrypt encrypted artifacts with (AES-256-GCM artifacts are limited to 256 MiB)"`
+		DeploymentOrder    string        `flag:"order" default:"mtime" description:"Strategy to determine the latest deployment (mtime, semver, lexical, timestamp)"`
+		DeploymentRetain   int           `flag:"deployment-retention" default:"5" description:"Number of deployments to keep inside the deployment root"`
+		DeploymentRoot     string        `flag:"deployment-root" default:"" description:"Directory to extract deployments to and to retain the last successful deployment in for its ApplicationStop hooks (Default: temporary directory, ApplicationStop disabled)"`
+		FetchCron          string        `flag:"fetch-cron,c" default:"* * * * *" description:"When to query for new deployments (cron syntax)"`
+		FileExistsBehavior string        `flag:"file-exists-behavior" default:"OVERWRITE" description:"How to handle files already existing at the destination unless set in the appspec (DISALLOW, OVERWRITE, RETAIN)"`
+		IgnoreStopFailures bool          `flag:"ignore-application-stop-failures" default:"false" description:"Continue the deployment if an ApplicationStop hook of the previous deployment fails"`
+		LogLevel           string        `flag:"log-level" default:"info" description:"Log level (debug, info, warn, error, fatal)"`
+		OrderTimestampFmt  string        `flag:"order-timestamp-format" default:"20060102150405" description:"Format of the timestamp inside deployment IDs for timestamp order (Go time layout or 'unix')"`
+		Pin                string        `flag:"pin" default:"" description:"Deployment ID to deploy instead of the latest deployment"`
+		PinFile            string        `flag:"pin-file" default:"" description:"File containing a deployment ID to deploy instead of the latest deployment"`
+		Reporters          []string      `flag:"reporter,r" default:"" description:"Reporting URIs to notify about deployments"`
+		SoftwareIdentifier string        `flag:"identifier,i" default:"default" description:"Software identifier to query deployments for"`
+		StorageCooldown    time.Duration `flag:"storage-cooldown" default:"5m" description:"How long to skip a failing storage when multiple storages are configured"`
+		StorageURIs        []string      `flag:"storage,s" default:"" description:"URIs for the storage providers to use (first has highest priority)" validate:"nonzero"`
+		TempDir            string        `flag:"temp-dir" default:"" description:"Directory to store downloaded artifacts in (Default: system temp dir)"`
+		TrustedKeys        []string      `flag:"trusted-key" default:"" description:"Minisign public keys (or key files) to verify artifact signatures against (Default: verification disabled)"`
+		VersionAndExit     bool          `flag:"version" default:"false" description:"Prints current version and exits"`
 
 		logLevel log.Level
 	}{}
 
+	artifactNaming  artifactNameTemplate
+	artifactStore   *artifactCache
+	decryptionKeys  decryptionKeySet
+	deploymentOrder deploymentLess
+	trustedKeys     []minisign.PublicKey
+
 	version = "dev"
 )
 
-func init() {
+// initConfig parses the commandline options and initializes the global
+// state derived from them. It is not executed in init() to keep the
+// package testable.
+func initConfig() {
 	if err := rconfig.ParseAndValidate(&cfg); err != nil {
 		log.Fatalf("Unable to parse commandline options: %s", err)
 	}
@@ -36,6 +64,44 @@ func init() {
 		os.Exit(0)
 	}
 
+	if t, err := newArtifactNameTemplate(cfg.ArtifactName, cfg.ArtifactIDPattern); err != nil {
+		log.WithError(err).Fatal("Unable to parse artifact name template")
+	} else {
+		artifactNaming = t
+	}
+
+	if artifactNaming.Ambiguous() {
+		log.WithField("artifact_name", artifactNaming).Info("Identifier and deployment ID are not separated, identifiers sharing a prefix match the artifacts of each other unless artifact-id-pattern is set")
+	}
+
+	if err := validateFileExistsBehavior(strings.ToUpper(cfg.FileExistsBehavior)); err != nil {
+		log.WithError(err).Fatal("Invalid file-exists-behavior")
+	}
+
+	if cfg.Pin != "" {
+		if err := validateDeploymentID(cfg.Pin); err != nil {
+			log.WithError(err).Fatal("Invalid pin")
+		}
+	}
+
+	if k, err := loadTrustedKeys(cfg.TrustedKeys); err != nil {
+		log.WithError(err).Fatal("Unable to load trusted keys")
+	} else {
+		trustedKeys = k
+	}
+
+	if k, err := loadDecryptionKeys(cfg.DecryptionKeys); err != nil {
+		log.WithError(err).Fatal("Unable to load decryption keys")
+	} else {
+		decryptionKeys = k
+	}
+
+	if o, err := getDeploymentOrder(cfg.DeploymentOrder, cfg.OrderTimestampFmt); err != nil {
+		log.WithError(err).Fatal("Unable to parse deployment order")
+	} else {
+		deploymentOrder = o
+	}
+
 	if l, err := log.ParseLevel(cfg.LogLevel); err != nil {
 		log.WithError(err).Fatal("Unable to parse log level")
 	} else {
@@ -45,13 +111,24 @@ func init() {
 }
 
 func main() {
-	var lastDeployed string
+	initConfig()
 
-	storage, err := getConfiguredStorageProvider(cfg.StorageURI)
+	var (
+		lastDeployed string
+		lastPin      deploymentPin
+	)
+
+	storage, err := getConfiguredStorage(cfg.StorageURIs, cfg.StorageCooldown)
 	if err != nil {
 		log.WithError(err).Fatal("Unable to open storage")
 	}
 
+	if cfg.CacheDir != "" {
+		if artifactStore, err = newArtifactCache(cfg.CacheDir, cfg.CacheSize*1024*1024); err != nil {
+			log.WithError(err).Fatal("Unable to initialize artifact cache")
+		}
+	}
+
 	reporting, err := initializeReporters(cfg.Reporters)
 	if err != nil {
 		log.WithError(err).Fatal("Unable to create reporters")
@@ -61,6 +138,14 @@ func main() {
 		"provider": storage.String(),
 	}).Debug("Storage initialized")
 
+	// First argument is the name of the binary itself
+	if args := rconfig.Args()[1:]; len(args) > 0 {
+		if err := runCommand(storage, args); err != nil {
+			log.WithError(err).Fatal("Command failed")
+		}
+		return
+	}
+
 	actChan := make(chan struct{}, 1)
 	actChan <- struct{}{}
 
@@ -76,26 +161,61 @@ func main() {
 		actLog.SetLevel(cfg.logLevel)
 		actLog.AddHook(buf)
 
-		actLog.Debug("Start fetching latest deployment")
-		deployment, err := storage.GetLatestDeployment(cfg.SoftwareIdentifier)
+		pin, err := resolvePin(storage, cfg.SoftwareIdentifier)
 		if err != nil {
-			actLog.WithError(err).Error("Unable to get latest deployment ID")
+			// Do not fall back to the latest deployment as the host might
+			// be pinned to a known-good deployment
+			actLog.WithError(err).Error("Unable to determine deployment pin")
 			continue
 		}
 
+		if pin != lastPin {
+			if pin.ID != "" {
+				actLog.WithField("pin", pin.String()).Warn("Deployment pinned, ignoring latest deployment")
+			} else {
+				actLog.Info("Deployment unpinned")
+			}
+			lastPin = pin
+		}
+
+		deployment := pin.ID
+		if deployment == "" {
+			actLog.Debug("Start fetching latest deployment")
+			if deployment, err = getLatestDeployment(storage, cfg.SoftwareIdentifier); err != nil {
+				actLog.WithError(err).Error("Unable to get latest deployment ID")
+				continue
+			}
+		}
+
 		logger := actLog.WithFields(log.Fields{
 			"deployment_id": deployment,
 		})
+		if pin.ID != "" {
+			logger = logger.WithField("pin", pin.String())
+		}
 
 		if deployment == lastDeployed {
-			logger.Debug("Latest deployment already deployed")
+			logger.Debug("Deployment already deployed")
 			continue
 		}
 
 		logger.Info("Starting deployment")
 
 		var success bool
-		if err := executeDeployment(storage, deployment, logger); err != nil {
+		metadata, err := storage.GetDeploymentArtifactMetadata(cfg.SoftwareIdentifier, deployment)
+		if err != nil {
+			err = fmt.Errorf("Unable to fetch artifact metadata: %s", err)
+		} else {
+			err = executeDeployment(storage, deployment, metadata, logger)
+		}
+
+		if mismatch, ok := err.(checksumMismatchError); ok {
+			logger.WithFields(log.Fields{
+				"algorithm": mismatch.Algorithm,
+				"expected":  mismatch.Expected,
+				"actual":    mismatch.Actual,
+			}).Error("Deployment failed, artifact does not match its checksums")
+		} else if err != nil {
 			logger.WithError(err).Error("Deployment failed")
 		} else {
 			lastDeployed = deployment
@@ -103,7 +223,7 @@ func main() {
 			success = true
 		}
 
-		if errs := reporting.Execute(success, buf.String(), deployment); errs != nil && len(errs) > 0 {
+		if errs := reporting.Execute(success, buf.String(), deployment, pin.String(), metadata); errs != nil && len(errs) > 0 {
 			for _, err := range errs {
 				log.WithError(err).Error("Failed sending report")
 			}
@@ -111,21 +231,173 @@ func main() {
 	}
 }
 
-func executeDeployment(storage storageProvider, deploymentIdentifer string, logger *log.Entry) error {
-	deployZipRaw, size, err := storage.GetDeploymentArtifact(cfg.SoftwareIdentifier, deploymentIdentifer)
+func executeDeployment(storage storageProvider, deploymentIdentifer string, metadata map[string]string, logger *log.Entry) error {
+	if len(metadata) > 0 {
+		fields := log.Fields{}
+		for k, v := range metadata {
+			fields["meta_"+k] = v
+		}
+		logger.WithFields(fields).Debug("Artifact metadata")
+	}
+
+	artifact, err := fetchArtifact(storage, cfg.SoftwareIdentifier, deploymentIdentifer, logger)
+	if err != nil {
+		if _, ok := err.(checksumMismatchError); ok {
+			// Passed on unwrapped to be reported as a mismatch
+			return err
+		}
+		return fmt.Errorf("Unable to fetch deployment artifact: %s", err)
+	}
+	defer artifact.Close()
+
+	if err := verifyArtifactSignature(storage, cfg.SoftwareIdentifier, deploymentIdentifer, artifact, logger); err != nil {
+		return fmt.Errorf("Signature verification failed: %s", err)
+	}
+
+	decrypted, name, err := decryptArtifact(artifact, artifactNaming.Name(cfg.SoftwareIdentifier, deploymentIdentifer), logger)
+	if err != nil {
+		return fmt.Errorf("Unable to decrypt deployment artifact: %s", err)
+	}
+	if decrypted != artifact {
+		defer decrypted.Close()
+	}
+
+	archive, err := openDeploymentArchive(decrypted, name)
 	if err != nil {
-		return fmt.Errorf("Unable to fetch deployment ZIP: %s", err)
+		return fmt.Errorf("Unable to read deployment archive: %s", err)
 	}
+	defer archive.Close()
 
-	zipFile, err := zip.NewReader(deployZipRaw, size)
+	as, err := parseAppSpec(archive)
 	if err != nil {
-		return fmt.Errorf("Unable to read deployment ZIP: %s", err)
+		return err
+	}
+
+	if cfg.DeploymentRoot == "" {
+		if len(as.Hooks["ApplicationStop"]) > 0 {
+			logger.Warn("Appspec contains ApplicationStop hooks which are not executed without deployment-root")
+		}
+
+		// Without a deployment root the bundle is extracted into a
+		// temporary directory removed after the deployment
+		root, err := ioutil.TempDir(cfg.TempDir, "deploy-root-")
+		if err != nil {
+			return fmt.Errorf("Unable to create temporary directory: %s", err)
+		}
+		defer os.RemoveAll(root)
+
+		if err := os.Chmod(root, revisionDirPerm); err != nil {
+			return fmt.Errorf("Unable to set mode of temporary directory: %s", err)
+		}
+
+		if err := extractArchive(archive, root); err != nil {
+			return fmt.Errorf("Unable to extract bundle: %s", err)
+		}
+
+		_, err = as.Execute(archive, root, logger, deploymentIdentifer, metadata, nil)
+		return err
 	}
 
-	as, err := parseZIPAppSpec(zipFile)
+	revisions, err := newRevisionStore(cfg.DeploymentRoot, cfg.SoftwareIdentifier)
 	if err != nil {
 		return err
 	}
 
-	return as.Execute(zipFile, logger, deploymentIdentifer)
+	previous, err := openPreviousRevision(revisions, logger)
+	if err != nil {
+		if !cfg.IgnoreStopFailures {
+			return fmt.Errorf("Unable to open previous deployment: %s", err)
+		}
+		logger.WithError(err).Warn("Unable to open previous deployment, skipping ApplicationStop")
+	}
+	if previous != nil {
+		defer previous.Close()
+	}
+
+	root, err := revisions.Prepare(deploymentIdentifer, decrypted, name, archive)
+	if err != nil {
+		return err
+	}
+
+	logger.WithField("root", root).Debug("Bundle extracted")
+
+	installed, err := as.Execute(archive, root, logger, deploymentIdentifer, metadata, previous)
+	if err == nil {
+		// Only the manifest of the last successful deployment is read by
+		// the next deployment
+		if merr := revisions.WriteManifest(deploymentIdentifer, installed); merr != nil {
+			logger.WithError(merr).Warn("Unable to record installed files")
+		}
+
+		if merr := revisions.MarkSuccessful(deploymentIdentifer); merr != nil {
+			// The deployment itself succeeded, only the ApplicationStop
+			// hooks of the next deployment will be executed from an older
+			// deployment
+			logger.WithError(merr).Warn("Unable to mark deployment as successful")
+		}
+	}
+
+	if cerr := revisions.Cleanup(cfg.DeploymentRetain, deploymentIdentifer); cerr != nil {
+		logger.WithError(cerr).Warn("Unable to remove old deployments")
+	}
+
+	return err
+}
+
+// openPreviousRevision opens the retained bundle of the last successful
+// deployment. If there is none nil is returned.
+func openPreviousRevision(revisions *revisionStore, logger *log.Entry) (*appspecRevision, error) {
+	deploymentID, err := revisions.Last()
+	if err != nil || deploymentID == "" {
+		return nil, err
+	}
+
+	artifact, name, err := revisions.Open(deploymentID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.WithField("previous_deployment_id", deploymentID).Debug("Previous deployment not retained, skipping ApplicationStop")
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	archive, err := openDeploymentArchive(artifact, name)
+	if err != nil {
+		artifact.Close()
+		return nil, err
+	}
+
+	as, err := parseAppSpec(archive)
+	if err != nil {
+		archive.Close()
+		artifact.Close()
+		return nil, err
+	}
+
+	installed, err := revisions.ReadManifest(deploymentID)
+	if err != nil {
+		archive.Close()
+		artifact.Close()
+		return nil, err
+	}
+
+	root := revisions.ArchiveDir(deploymentID)
+	if !fileExists(root) {
+		// The hooks are executed from the extracted bundle
+		if err := extractArchive(archive, root); err != nil {
+			archive.Close()
+			artifact.Close()
+			return nil, fmt.Errorf("Unable to extract bundle: %s", err)
+		}
+	}
+
+	return &appspecRevision{
+		DeploymentID: deploymentID,
+		Appspec:      as,
+		Archive:      archive,
+		Root:         root,
+		Installed:    installed,
+
+		artifact: artifact,
+	}, nil
 }
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// Defaults of the commandline options required by the tests
+	cfg.ArtifactName = "{identifier}{id}.zip"
+	cfg.DeploymentOrder = orderByModTime
+
+	var err error
+	if artifactNaming, err = newArtifactNameTemplate(cfg.ArtifactName, cfg.ArtifactIDPattern); err != nil {
+		panic(err)
+	}
+	if deploymentOrder, err = getDeploymentOrder(cfg.DeploymentOrder, ""); err != nil {
+		panic(err)
+	}
+
+	log.SetOutput(ioutil.Discard)
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	metadataSuffix    = ".json"
+	metadataEnvPrefix = "DEPLOY_META_"
+)
+
+var metadataEnvInvalidChars = regexp.MustCompile(`[^A-Z0-9_]`)
+
+// fetchMetadataSidecar reads the metadata of the artifact from the JSON
+// sidecar object stored next to it. String values are used as they are,
+// all other values in their JSON representation. If there is no sidecar
+// nil is returned.
+func fetchMetadataSidecar(s storageProvider, identifier, deploymentID string) (map[string]string, error) {
+	name := artifactNaming.Name(identifier, deploymentID) + metadataSuffix
+
+	buf := new(bytes.Buffer)
+	if err := s.GetObject(name, buf); err != nil {
+		if err == errNoSuchObject {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Unable to fetch metadata %q: %s", name, err)
+	}
+
+	raw := map[string]json.RawMessage{}
+	if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+		return nil, fmt.Errorf("Unable to parse metadata %q: %s", name, err)
+	}
+
+	metadata := map[string]string{}
+	for k, v := range raw {
+		var str string
+		if err := json.Unmarshal(v, &str); err != nil {
+			str = string(v)
+		}
+		metadata[k] = str
+	}
+
+	return metadata, nil
+}
+
+// metadataEnvironment converts the metadata keys into environment
+// variable names (`commit-sha` becomes `DEPLOY_META_COMMIT_SHA`)
+func metadataEnvironment(metadata map[string]string) map[string]string {
+	environ := map[string]string{}
+	for k, v := range metadata {
+		environ[metadataEnvPrefix+metadataEnvInvalidChars.ReplaceAllString(strings.ToUpper(k), "_")] = v
+	}
+	return environ
+}
+
+// sortedMetadataKeys returns the keys of the metadata in a stable order
+// for reporting
+func sortedMetadataKeys(metadata map[string]string) []string {
+	keys := []string{}
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// headerMetadata extracts the user metadata from the response headers
+// using the given header prefix (like `X-Amz-Meta-`)
+func headerMetadata(h http.Header, prefix string) map[string]string {
+	var metadata map[string]string
+	for k, v := range h {
+		if !strings.HasPrefix(k, prefix) || len(v) == 0 {
+			continue
+		}
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		metadata[strings.ToLower(strings.TrimPrefix(k, prefix))] = v[0]
+	}
+	return metadata
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	namingPlaceholderID         = "{id}"
+	namingPlaceholderIdentifier = "{identifier}"
+)
+
+// auxiliarySuffixes contains the suffixes of the objects stored next to
+// the artifacts (pointers, pins and sidecars) which are never artifacts
+// themselves even if their names match the artifact name template
+var auxiliarySuffixes = []string{
+	checksumSuffix,
+	latestPointerSuffix,
+	metadataSuffix,
+	pinSuffix,
+	signatureSuffix,
+}
+
+// artifactNameTemplate describes how artifacts are named inside the
+// storage relative to its root, for example `{identifier}/{id}.zip`
+type artifactNameTemplate struct {
+	format string
+
+	before string
+	after  string
+
+	// idPattern optionally restricts the deployment IDs matched by the
+	// template to tell identifiers sharing a prefix apart
+	idPattern *regexp.Regexp
+}
+
+func newArtifactNameTemplate(format, idPattern string) (artifactNameTemplate, error) {
+	t := artifactNameTemplate{format: format}
+
+	if strings.Count(format, namingPlaceholderID) != 1 {
+		return t, fmt.Errorf("Artifact name template %q must contain %s exactly once", format, namingPlaceholderID)
+	}
+
+	if strings.Count(format, namingPlaceholderIdentifier) != 1 {
+		return t, fmt.Errorf("Artifact name template %q must contain %s exactly once", format, namingPlaceholderIdentifier)
+	}
+
+	if strings.HasPrefix(format, "/") || path.Clean(format) != format || strings.Contains(format, "..") {
+		return t, fmt.Errorf("Artifact name template %q must be a clean relative path", format)
+	}
+
+	parts := strings.SplitN(format, namingPlaceholderID, 2)
+	t.before, t.after = parts[0], parts[1]
+
+	if strings.Contains(t.after, "/") {
+		// All artifacts of one identifier need to be stored inside the
+		// same directory to be listed efficiently
+		return t, fmt.Errorf("Artifact name template %q must not contain a path separator after %s", format, namingPlaceholderID)
+	}
+
+	if idPattern != "" {
+		var err error
+		if t.idPattern, err = regexp.Compile(`^(?:` + idPattern + `)$`); err != nil {
+			return t, fmt.Errorf("Invalid artifact ID pattern %q: %s", idPattern, err)
+		}
+	}
+
+	return t, nil
+}
+
+// Ambiguous reports whether the identifier directly touches the
+// deployment ID without an ID pattern: The identifier `api` then also
+// matches the artifacts of the identifier `api-admin`.
+func (a artifactNameTemplate) Ambiguous() bool {
+	if a.idPattern != nil {
+		return false
+	}
+	return strings.HasSuffix(a.before, namingPlaceholderIdentifier) || strings.HasPrefix(a.after, namingPlaceholderIdentifier)
+}
+
+// Name returns the name of the artifact for the given deployment
+func (a artifactNameTemplate) Name(identifier, deploymentID string) string {
+	return a.Prefix(identifier) + deploymentID + a.suffix(identifier)
+}
+
+// Extension returns the extension of the artifact names (everything
+// behind the first dot following the deployment ID and identifier, for
+// example `.tar.gz`) or an empty string if they have none
+func (a artifactNameTemplate) Extension() string {
+	after := a.after
+	if i := strings.LastIndex(after, namingPlaceholderIdentifier); i >= 0 {
+		after = after[i+len(namingPlaceholderIdentifier):]
+	}
+
+	if i := strings.Index(after, "."); i >= 0 {
+		return after[i:]
+	}
+	return ""
+}
+
+// Prefix returns the part of the artifact names of the identifier in
+// front of the deployment ID to be used for prefix listings
+func (a artifactNameTemplate) Prefix(identifier string) string {
+	return strings.Replace(a.before, namingPlaceholderIdentifier, identifier, 1)
+}
+
+// Dir returns the directory containing all artifacts of the identifier
+// or an empty string for the root of the storage
+func (a artifactNameTemplate) Dir(identifier string) string {
+	if dir := path.Dir(a.Prefix(identifier)); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// ParseID extracts the deployment ID from the given artifact name. If the
+// name does not belong to the identifier, is the name of an auxiliary
+// object or the extracted ID is not valid or does not match the ID
+// pattern false is returned.
+func (a artifactNameTemplate) ParseID(identifier, name string) (string, bool) {
+	prefix, suffix := a.Prefix(identifier), a.suffix(identifier)
+
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return "", false
+	}
+
+	for _, s := range auxiliarySuffixes {
+		if strings.HasSuffix(name, s) {
+			return "", false
+		}
+	}
+
+	deploymentID := name[len(prefix) : len(name)-len(suffix)]
+	if validateDeploymentID(deploymentID) != nil {
+		return "", false
+	}
+
+	if a.idPattern != nil && !a.idPattern.MatchString(deploymentID) {
+		return "", false
+	}
+
+	return deploymentID, true
+}
+
+func (a artifactNameTemplate) String() string { return a.format }
+
+func (a artifactNameTemplate) suffix(identifier string) string {
+	return strings.Replace(a.after, namingPlaceholderIdentifier, identifier, 1)
+}
+
+// validateDeploymentID ensures the deployment ID can safely be used to
+// build names of artifacts, files and objects
+func validateDeploymentID(deploymentID string) error {
+	switch {
+	case deploymentID == "":
+		return fmt.Errorf("Deployment ID must not be empty")
+
+	case strings.ContainsAny(deploymentID, `/\`):
+		return fmt.Errorf("Deployment ID %q must not contain path separators", deploymentID)
+
+	case strings.Contains(deploymentID, ".."):
+		return fmt.Errorf("Deployment ID %q must not contain traversal sequences", deploymentID)
+
+	case strings.IndexFunc(deploymentID, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		return fmt.Errorf("Deployment ID %q must not contain control characters", deploymentID)
+	}
+
+	return nil
+}
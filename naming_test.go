@@ -0,0 +1,103 @@
+package main
+
+import "testing"
+
+func TestArtifactNameTemplateAllowsSeparatorInIDs(t *testing.T) {
+	tpl, err := newArtifactNameTemplate("{identifier}-{id}.zip", "")
+	if err != nil {
+		t.Fatalf("Unable to parse template: %s", err)
+	}
+
+	for name, expected := range map[string]string{
+		"api-123.zip":                                  "123",
+		"api-1.2.0-rc1.zip":                            "1.2.0-rc1",
+		"api-2020-01-02-150405.zip":                    "2020-01-02-150405",
+		"api-0e4b5f3c-7d2a-4c4e-9b9a-3f1f2d6c8a11.zip": "0e4b5f3c-7d2a-4c4e-9b9a-3f1f2d6c8a11",
+	} {
+		if id, ok := tpl.ParseID("api", name); !ok || id != expected {
+			t.Errorf("Expected deployment %q for %s, got %q (%v)", expected, name, id, ok)
+		}
+	}
+
+	for _, name := range []string{"api-123.zip.sig", "api-.zip", "other-123.zip", "api-123.tar"} {
+		if id, ok := tpl.ParseID("api", name); ok {
+			t.Errorf("Name %s was matched as deployment %q", name, id)
+		}
+	}
+}
+
+func TestArtifactNameTemplateDefault(t *testing.T) {
+	tpl, err := newArtifactNameTemplate("{identifier}{id}.zip", "")
+	if err != nil {
+		t.Fatalf("Unable to parse default template: %s", err)
+	}
+
+	if !tpl.Ambiguous() {
+		t.Error("Template without separator is not reported as ambiguous")
+	}
+
+	if id, ok := tpl.ParseID("default", "defaultxyz123.zip"); !ok || id != "xyz123" {
+		t.Errorf("Expected deployment xyz123, got %q (%v)", id, ok)
+	}
+
+	if name := tpl.Name("default", "1.2.0-rc1"); name != "default1.2.0-rc1.zip" {
+		t.Errorf("Unexpected artifact name %q", name)
+	}
+}
+
+func TestArtifactNameTemplateIDPattern(t *testing.T) {
+	tpl, err := newArtifactNameTemplate("{identifier}{id}.zip", "[0-9]+")
+	if err != nil {
+		t.Fatalf("Unable to parse template: %s", err)
+	}
+
+	if tpl.Ambiguous() {
+		t.Error("Template with ID pattern is reported as ambiguous")
+	}
+
+	if id, ok := tpl.ParseID("api", "api123.zip"); !ok || id != "123" {
+		t.Errorf("Expected deployment 123, got %q (%v)", id, ok)
+	}
+
+	if id, ok := tpl.ParseID("api", "api-admin123.zip"); ok {
+		t.Errorf("Artifact of api-admin was matched as deployment %q of api", id)
+	}
+
+	if _, err := newArtifactNameTemplate("{identifier}-{id}.zip", "[0-9"); err == nil {
+		t.Error("Invalid ID pattern was accepted")
+	}
+}
+
+func TestArtifactNameTemplateRefusesInvalidTemplates(t *testing.T) {
+	for _, format := range []string{
+		"{identifier}.zip",
+		"{id}{id}{identifier}.zip",
+		"/{identifier}{id}.zip",
+		"../{identifier}{id}.zip",
+		"{identifier}{id}/artifact.zip",
+	} {
+		if _, err := newArtifactNameTemplate(format, ""); err == nil {
+			t.Errorf("Invalid template %q was accepted", format)
+		}
+	}
+}
+
+func TestArtifactNameTemplateExtension(t *testing.T) {
+	for format, expected := range map[string]string{
+		"{identifier}{id}.zip":             ".zip",
+		"{identifier}/{id}.tar.gz":         ".tar.gz",
+		"{identifier}-{id}.zip.age":        ".zip.age",
+		"{id}.{identifier}.tar.zst":        ".tar.zst",
+		"{identifier}/{id}":                "",
+		"releases/{identifier}-{id}-build": "",
+	} {
+		tpl, err := newArtifactNameTemplate(format, "")
+		if err != nil {
+			t.Fatalf("Unable to parse template %q: %s", format, err)
+		}
+
+		if ext := tpl.Extension(); ext != expected {
+			t.Errorf("%s: Expected extension %q, got %q", format, expected, ext)
+		}
+	}
+}
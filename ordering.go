@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	orderByModTime   = "mtime"
+	orderBySemver    = "semver"
+	orderByLexical   = "lexical"
+	orderByTimestamp = "timestamp"
+
+	timestampFormatUnix = "unix"
+)
+
+var semverMatcher = regexp.MustCompile(`v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?`)
+
+// deploymentCandidate is a deployment found inside the storage provider
+// which might be selected as the latest deployment
+type deploymentCandidate struct {
+	ID       string
+	Modified time.Time
+}
+
+// deploymentLess reports whether candidate a is older than candidate b
+type deploymentLess func(a, b deploymentCandidate) bool
+
+func getDeploymentOrder(strategy, timestampFormat string) (deploymentLess, error) {
+	switch strategy {
+	case orderByModTime:
+		return lessByModTime, nil
+
+	case orderBySemver:
+		return lessBySemver, nil
+
+	case orderByLexical:
+		return func(a, b deploymentCandidate) bool { return a.ID < b.ID }, nil
+
+	case orderByTimestamp:
+		parse, err := embeddedTimestampParser(timestampFormat)
+		if err != nil {
+			return nil, err
+		}
+		return func(a, b deploymentCandidate) bool {
+			ta, aok := parse(a.ID)
+			tb, bok := parse(b.ID)
+			if aok != bok {
+				// Deployments without timestamp are considered older
+				return bok
+			}
+			if !aok || ta.Equal(tb) {
+				return lessByModTime(a, b)
+			}
+			return ta.Before(tb)
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("Unknown deployment order %q", strategy)
+	}
+}
+
+// selectLatestDeployment orders the given candidates using the configured
+// strategy and returns the latest deployment. If no candidates are given
+// errNoDeploymentFound is returned.
+func selectLatestDeployment(candidates []deploymentCandidate) (deploymentCandidate, error) {
+	if len(candidates) == 0 {
+		return deploymentCandidate{}, errNoDeploymentFound
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return deploymentOrder(candidates[i], candidates[j])
+	})
+
+	return candidates[len(candidates)-1], nil
+}
+
+func lessByModTime(a, b deploymentCandidate) bool {
+	if a.Modified.Equal(b.Modified) {
+		return a.ID < b.ID
+	}
+	return a.Modified.Before(b.Modified)
+}
+
+// lessBySemver compares the first semantic version found in the
+// deployment IDs following the precedence rules of semver 2.0.0
+func lessBySemver(a, b deploymentCandidate) bool {
+	va := semverMatcher.FindStringSubmatch(a.ID)
+	vb := semverMatcher.FindStringSubmatch(b.ID)
+
+	if (va == nil) != (vb == nil) {
+		// Deployments without version are considered older
+		return va == nil
+	}
+
+	if va == nil {
+		return lessByModTime(a, b)
+	}
+
+	for i := 1; i <= 3; i++ {
+		na, _ := strconv.ParseUint(va[i], 10, 64)
+		nb, _ := strconv.ParseUint(vb[i], 10, 64)
+		if na != nb {
+			return na < nb
+		}
+	}
+
+	if c := comparePrerelease(va[4], vb[4]); c != 0 {
+		return c < 0
+	}
+
+	return lessByModTime(a, b)
+}
+
+func comparePrerelease(a, b string) int {
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		// Release has higher precedence than any pre-release
+		return 1
+	case b == "":
+		return -1
+	}
+
+	pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		na, aErr := strconv.ParseUint(pa[i], 10, 64)
+		nb, bErr := strconv.ParseUint(pb[i], 10, 64)
+
+		switch {
+		case aErr == nil && bErr == nil:
+			if na != nb {
+				if na < nb {
+					return -1
+				}
+				return 1
+			}
+		case aErr == nil:
+			// Numeric identifiers have lower precedence
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(pa[i], pb[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	switch {
+	case len(pa) < len(pb):
+		return -1
+	case len(pa) > len(pb):
+		return 1
+	}
+	return 0
+}
+
+// embeddedTimestampParser creates a function to extract a timestamp in
+// the given format (Go time layout or "unix") from a deployment ID. Only
+// layouts consisting of numeric elements and separators are supported.
+func embeddedTimestampParser(format string) (func(string) (time.Time, bool), error) {
+	if format == timestampFormatUnix {
+		matcher := regexp.MustCompile(`\d{10}`)
+		return func(id string) (time.Time, bool) {
+			m := matcher.FindString(id)
+			if m == "" {
+				return time.Time{}, false
+			}
+			sec, _ := strconv.ParseInt(m, 10, 64)
+			return time.Unix(sec, 0), true
+		}, nil
+	}
+
+	expr := ""
+	for _, c := range format {
+		switch {
+		case c >= '0' && c <= '9':
+			expr += `\d`
+		case strings.ContainsRune("-_.:T ", c):
+			expr += regexp.QuoteMeta(string(c))
+		default:
+			return nil, fmt.Errorf("Timestamp format %q contains non-numeric element %q", format, c)
+		}
+	}
+
+	matcher, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(id string) (time.Time, bool) {
+		for _, m := range matcher.FindAllString(id, -1) {
+			if t, err := time.Parse(format, m); err == nil {
+				return t, true
+			}
+		}
+		return time.Time{}, false
+	}, nil
+}
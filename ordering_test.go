@@ -0,0 +1,129 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelectLatestDeployment(t *testing.T) {
+	defer func(order deploymentLess) { deploymentOrder = order }(deploymentOrder)
+
+	now := time.Now()
+	candidate := func(id string, age time.Duration) deploymentCandidate {
+		return deploymentCandidate{ID: id, Modified: now.Add(-age)}
+	}
+
+	for name, c := range map[string]struct {
+		strategy, timestampFormat string
+		candidates                []deploymentCandidate
+		expected                  string
+	}{
+		"mtime": {
+			strategy:   orderByModTime,
+			candidates: []deploymentCandidate{candidate("2", time.Hour), candidate("1", 0)},
+			expected:   "1",
+		},
+		"mtime equal uses ID": {
+			strategy:   orderByModTime,
+			candidates: []deploymentCandidate{candidate("b", 0), candidate("a", 0)},
+			expected:   "b",
+		},
+		"semver ignores re-uploads": {
+			strategy:   orderBySemver,
+			candidates: []deploymentCandidate{candidate("v1.10.0", time.Hour), candidate("v1.9.0", 0)},
+			expected:   "v1.10.0",
+		},
+		"semver release after pre-release": {
+			strategy:   orderBySemver,
+			candidates: []deploymentCandidate{candidate("1.0.0", time.Hour), candidate("1.0.0-rc.2", 0), candidate("1.0.0-rc.10", 0)},
+			expected:   "1.0.0",
+		},
+		"semver pre-release precedence": {
+			strategy:   orderBySemver,
+			candidates: []deploymentCandidate{candidate("1.0.0-alpha.beta", 0), candidate("1.0.0-rc.1", time.Hour), candidate("1.0.0-alpha.1", 0)},
+			expected:   "1.0.0-rc.1",
+		},
+		"semver ignores build metadata": {
+			strategy:   orderBySemver,
+			candidates: []deploymentCandidate{candidate("app-2.0.0+build.2", time.Hour), candidate("app-2.0.0+build.1", 0)},
+			expected:   "app-2.0.0+build.1",
+		},
+		"semver without version is older": {
+			strategy:   orderBySemver,
+			candidates: []deploymentCandidate{candidate("0.1.0", time.Hour), candidate("hotfix", 0)},
+			expected:   "0.1.0",
+		},
+		"lexical": {
+			strategy:   orderByLexical,
+			candidates: []deploymentCandidate{candidate("b", time.Hour), candidate("a", 0)},
+			expected:   "b",
+		},
+		"timestamp": {
+			strategy:        orderByTimestamp,
+			timestampFormat: "20060102150405",
+			candidates:      []deploymentCandidate{candidate("build-20200102030405", time.Hour), candidate("build-20200101030405", 0)},
+			expected:        "build-20200102030405",
+		},
+		"timestamp with separators": {
+			strategy:        orderByTimestamp,
+			timestampFormat: "2006-01-02T15-04-05",
+			candidates:      []deploymentCandidate{candidate("2020-01-02T03-04-05-abc", time.Hour), candidate("2019-12-31T23-59-59-def", 0)},
+			expected:        "2020-01-02T03-04-05-abc",
+		},
+		"timestamp without timestamp is older": {
+			strategy:        orderByTimestamp,
+			timestampFormat: "20060102150405",
+			candidates:      []deploymentCandidate{candidate("20200102030405", time.Hour), candidate("latest", 0)},
+			expected:        "20200102030405",
+		},
+		"unix timestamp": {
+			strategy:        orderByTimestamp,
+			timestampFormat: timestampFormatUnix,
+			candidates:      []deploymentCandidate{candidate("1600000000-a", time.Hour), candidate("1500000000-b", 0)},
+			expected:        "1600000000-a",
+		},
+	} {
+		var err error
+		if deploymentOrder, err = getDeploymentOrder(c.strategy, c.timestampFormat); err != nil {
+			t.Fatalf("%s: Unable to create order: %s", name, err)
+		}
+
+		if latest, err := selectLatestDeployment(c.candidates); err != nil || latest.ID != c.expected {
+			t.Errorf("%s: Expected %q, got %q (%v)", name, c.expected, latest.ID, err)
+		}
+	}
+
+	if _, err := selectLatestDeployment(nil); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound without candidates, got %v", err)
+	}
+}
+
+func TestGetDeploymentOrderRefusesInvalidOptions(t *testing.T) {
+	if _, err := getDeploymentOrder("newest", ""); err == nil {
+		t.Error("Unknown order was accepted")
+	}
+
+	if _, err := getDeploymentOrder(orderByTimestamp, "Jan 2 2006"); err == nil {
+		t.Error("Timestamp format with non-numeric elements was accepted")
+	}
+}
+
+func TestMultiLatestDeploymentUsesSemverOrder(t *testing.T) {
+	defer func(order deploymentLess) { deploymentOrder = order }(deploymentOrder)
+
+	var err error
+	if deploymentOrder, err = getDeploymentOrder(orderBySemver, ""); err != nil {
+		t.Fatalf("Unable to create order: %s", err)
+	}
+
+	now := time.Now()
+
+	// The old release copied to the mirror has a newer modification time
+	primary := &fakeStorage{name: "primary", latest: deploymentCandidate{ID: "v2.0.0", Modified: now.Add(-time.Hour)}}
+	mirror := &fakeStorage{name: "mirror", latest: deploymentCandidate{ID: "v1.0.0", Modified: now}}
+
+	latest, err := newStorageMulti([]storageProvider{primary, mirror}, time.Minute).GetLatestDeployment("default")
+	if err != nil || latest.ID != "v2.0.0" {
+		t.Errorf("Expected the highest version, got %q (%v)", latest.ID, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const pinSuffix = ".pin"
+
+// deploymentPin describes a deployment the host is pinned to
+type deploymentPin struct {
+	ID     string
+	Source string
+}
+
+// String returns a human readable description of the pin for logs and
+// reports, an empty string if no deployment is pinned
+func (d deploymentPin) String() string {
+	if d.ID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s (%s)", d.ID, d.Source)
+}
+
+// resolvePin determines the deployment the host is pinned to: The `pin`
+// flag takes precedence over the local pin file which takes precedence
+// over the pin object in the storage. If no pin is set an empty pin is
+// returned.
+func resolvePin(s storageProvider, identifier string) (deploymentPin, error) {
+	if cfg.Pin != "" {
+		return newDeploymentPin(cfg.Pin, "flag")
+	}
+
+	if cfg.PinFile != "" {
+		raw, err := ioutil.ReadFile(cfg.PinFile)
+		switch {
+		case err == nil:
+			if id := strings.TrimSpace(string(raw)); id != "" {
+				return newDeploymentPin(id, "file "+cfg.PinFile)
+			}
+		case !os.IsNotExist(err):
+			return deploymentPin{}, fmt.Errorf("Unable to read pin file: %s", err)
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	switch err := s.GetObject(identifier+pinSuffix, buf); err {
+	case nil:
+		if id := strings.TrimSpace(buf.String()); id != "" {
+			return newDeploymentPin(id, "storage object "+identifier+pinSuffix)
+		}
+	case errNoSuchObject, errNotSupported:
+		// No pin in storage
+	default:
+		return deploymentPin{}, fmt.Errorf("Unable to read pin object: %s", err)
+	}
+
+	return deploymentPin{}, nil
+}
+
+func newDeploymentPin(id, source string) (deploymentPin, error) {
+	if err := validateDeploymentID(id); err != nil {
+		return deploymentPin{}, fmt.Errorf("Invalid pin from %s: %s", source, err)
+	}
+	return deploymentPin{ID: id, Source: source}, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestResolvePin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-pin-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	pinFile := path.Join(dir, "pin")
+	if err := ioutil.WriteFile(pinFile, []byte("file-pin\n"), 0644); err != nil {
+		t.Fatalf("Unable to write pin file: %s", err)
+	}
+	emptyPinFile := path.Join(dir, "empty")
+	if err := ioutil.WriteFile(emptyPinFile, []byte("\n"), 0644); err != nil {
+		t.Fatalf("Unable to write pin file: %s", err)
+	}
+
+	outage := errors.New("503 Service Unavailable")
+	stored := map[string]string{"default.pin": "storage-pin\n"}
+
+	defer func(pin, pinFile string) { cfg.Pin, cfg.PinFile = pin, pinFile }(cfg.Pin, cfg.PinFile)
+
+	for name, c := range map[string]struct {
+		flag, file string
+		storage    storageProvider
+
+		expected string
+		fails    bool
+	}{
+		"flag before file and storage": {flag: "flag-pin", file: pinFile, storage: &fakeStorage{err: outage}, expected: "flag-pin"},
+		"file before storage":          {file: pinFile, storage: &fakeStorage{objects: stored}, expected: "file-pin"},
+		"empty file":                   {file: emptyPinFile, storage: &fakeStorage{objects: stored}, expected: "storage-pin"},
+		"missing file":                 {file: path.Join(dir, "missing"), storage: &fakeStorage{objects: stored}, expected: "storage-pin"},
+		"storage":                      {storage: &fakeStorage{objects: stored}, expected: "storage-pin"},
+		"not pinned":                   {storage: &fakeStorage{}},
+		"invalid flag":                 {flag: "../1", storage: &fakeStorage{}, fails: true},
+		"invalid storage object":       {storage: &fakeStorage{objects: map[string]string{"default.pin": "a/b"}}, fails: true},
+		"unreadable file":              {file: dir, storage: &fakeStorage{objects: stored}, fails: true},
+		"failing storage":              {storage: &fakeStorage{err: outage}, fails: true},
+		"pin on failing source": {
+			storage: newStorageMulti([]storageProvider{
+				&fakeStorage{name: "primary", err: outage},
+				&fakeStorage{name: "mirror"},
+			}, time.Minute),
+			fails: true,
+		},
+	} {
+		cfg.Pin, cfg.PinFile = c.flag, c.file
+
+		pin, err := resolvePin(c.storage, "default")
+		switch {
+		case c.fails && err == nil:
+			t.Errorf("%s: Expected error, got pin %q", name, pin.ID)
+		case !c.fails && err != nil:
+			t.Errorf("%s: Unexpected error: %s", name, err)
+		case pin.ID != c.expected:
+			t.Errorf("%s: Expected pin %q, got %q", name, c.expected, pin.ID)
+		}
+	}
+}
@@ -1,9 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
 	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type storageProvider interface {
@@ -13,22 +22,62 @@ type storageProvider interface {
 	// the initialization failed because of an error it must be returned.
 	InitializeFromURI(uri string) error
 	// GetLatestDeployment retrieves a software identifier and must return the
-	// latest deployment ID for this software. In case a the identifier does not
-	// exist an errNoDeploymentFound error must be returned.
-	GetLatestDeployment(identifier string) (string, error)
-	// GetDeploymentArtifact retrieves an software identifier and a deployment
-	// ID and must return an io.ReaderAt containing the ZIP-file of the artifact
-	// and the size of the ZIP-file. In case there is no artifact for the given
-	// identifier and deploymentID an errNoSuchDeployment error must be returned.
-	GetDeploymentArtifact(identifier, deploymentID string) (io.ReaderAt, int64, error)
+	// latest deployment for this software (its ID and, if known, the time it
+	// was last modified). In case a the identifier does not exist an
+	// errNoDeploymentFound error must be returned.
+	GetLatestDeployment(identifier string) (deploymentCandidate, error)
+	// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+	// and a writer and must write the archive of the artifact into the writer.
+	// In case there is no artifact for the given identifier and deploymentID an
+	// errNoSuchDeployment error must be returned.
+	GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error
+	// GetDeploymentArtifactVersion retrieves an software identifier and a
+	// deployment ID and must return a string identifying the current revision
+	// of the artifact (generation, ETag, checksum, ...) which changes whenever
+	// the artifact is replaced. If the provider is not able to determine the
+	// revision an empty string must be returned. In case there is no artifact
+	// for the given identifier and deploymentID an errNoSuchDeployment error
+	// must be returned.
+	GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error)
+	// GetDeploymentArtifactChecksums retrieves an software identifier and a
+	// deployment ID and must return the checksums of the artifact known to
+	// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+	// not know must be left empty. In case there is no artifact for the
+	// given identifier and deploymentID an errNoSuchDeployment error must
+	// be returned.
+	GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error)
+	// GetDeploymentArtifactMetadata retrieves an software identifier and a
+	// deployment ID and must return the metadata attached to the artifact
+	// (like commit SHA, author or changelog). Providers not able to store
+	// metadata with the artifact read it from a JSON sidecar object (see
+	// fetchMetadataSidecar). If there is no metadata nil must be returned.
+	GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error)
+	// GetObject retrieves the name of an auxiliary object (like the latest
+	// pointer) stored next to the artifacts and must write its content into
+	// the writer. In case the object does not exist an errNoSuchObject error
+	// must be returned.
+	GetObject(name string, dst io.Writer) error
+	// PutObject retrieves the name of an auxiliary object and its content
+	// and must store the object next to the artifacts. If the provider does
+	// not support writing objects an errNotSupported error must be returned.
+	PutObject(name string, content []byte) error
+	// DeleteObject retrieves the name of an auxiliary object and must remove
+	// the object. Removing a non-existent object must not cause an error. If
+	// the provider does not support writing objects an errNotSupported error
+	// must be returned.
+	DeleteObject(name string) error
 	// String must return a string representation of the provider for debug logging
 	String() string
 }
 
+const latestPointerSuffix = ".latest"
+
 var (
 	errInitializationNotPossible = errors.New("Initialization not possible from given URI")
 	errNoDeploymentFound         = errors.New("No deployment was found for the given identifier")
 	errNoSuchDeployment          = errors.New("The given deployment id was not found for the identifier")
+	errNoSuchObject              = errors.New("The requested object was not found")
+	errNotSupported              = errors.New("The operation is not supported by the storage provider")
 
 	storageProviders    []storageProvider
 	storageProviderLock sync.Mutex
@@ -46,10 +95,189 @@ func getConfiguredStorageProvider(uri string) (storageProvider, error) {
 	defer storageProviderLock.Unlock()
 
 	for _, sp := range storageProviders {
-		if err := sp.InitializeFromURI(uri); err == nil {
-			return sp, nil
+		// Use a new instance for every URI as multiple sources might use
+		// the same provider
+		inst := reflect.New(reflect.TypeOf(sp).Elem()).Interface().(storageProvider)
+		switch err := inst.InitializeFromURI(uri); err {
+		case nil:
+			return inst, nil
+		case errInitializationNotPossible:
+		default:
+			return nil, err
 		}
 	}
 
 	return nil, errInitializationNotPossible
 }
+
+// getConfiguredStorage initializes a provider for every URI and combines
+// them into a multi-source provider if more than one URI is given
+func getConfiguredStorage(uris []string, cooldown time.Duration) (storageProvider, error) {
+	var providers []storageProvider
+
+	for _, uri := range uris {
+		if uri == "" {
+			continue
+		}
+
+		sp, err := getConfiguredStorageProvider(uri)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to initialize storage %q: %s", uri, err)
+		}
+		providers = append(providers, sp)
+	}
+
+	switch len(providers) {
+	case 0:
+		return nil, errors.New("No storage URI given")
+	case 1:
+		return providers[0], nil
+	default:
+		return newStorageMulti(providers, cooldown), nil
+	}
+}
+
+// getLatestDeployment returns the deployment ID stored in the latest
+// pointer object of the identifier and falls back to the detection of
+// the storage provider if there is no such pointer
+func getLatestDeployment(s storageProvider, identifier string) (string, error) {
+	buf := new(bytes.Buffer)
+
+	switch err := s.GetObject(identifier+latestPointerSuffix, buf); err {
+	case nil:
+		if deploymentID := strings.TrimSpace(buf.String()); deploymentID != "" {
+			if err := validateDeploymentID(deploymentID); err != nil {
+				return "", fmt.Errorf("Invalid latest pointer: %s", err)
+			}
+			return deploymentID, nil
+		}
+
+	case errNoSuchObject:
+		// No pointer present, use detection
+
+	default:
+		return "", fmt.Errorf("Unable to read latest pointer: %s", err)
+	}
+
+	latest, err := s.GetLatestDeployment(identifier)
+	return latest.ID, err
+}
+
+// deploymentArtifact is a local copy of the archive of an artifact
+// which is either stored in the artifact cache or in a temporary file
+type deploymentArtifact struct {
+	*os.File
+	Size int64
+
+	temporary bool
+}
+
+// Close closes the underlying file and removes it if it is not stored
+// inside the artifact cache
+func (d deploymentArtifact) Close() error {
+	err := d.File.Close()
+	if d.temporary {
+		if rerr := os.Remove(d.File.Name()); rerr != nil {
+			return rerr
+		}
+	}
+	return err
+}
+
+// fetchArtifact retrieves the artifact from the artifact cache if
+// available or from the storage provider otherwise and verifies its
+// checksums. The returned artifact needs to be closed after usage.
+func fetchArtifact(s storageProvider, identifier, deploymentID string, logger *log.Entry) (*deploymentArtifact, error) {
+	if err := validateDeploymentID(deploymentID); err != nil {
+		return nil, err
+	}
+
+	artifact, cacheVersion, err := loadArtifact(s, identifier, deploymentID, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := verifyArtifactChecksums(s, identifier, deploymentID, artifact); err != nil {
+		artifact.Close()
+
+		if _, ok := err.(checksumMismatchError); ok && cacheVersion != "" {
+			// Do not reuse the broken artifact on the next try
+			if err := artifactStore.Remove(identifier, deploymentID, cacheVersion); err != nil {
+				logger.WithError(err).Warn("Unable to remove artifact from cache")
+			}
+		}
+
+		return nil, err
+	}
+
+	return artifact, nil
+}
+
+// loadArtifact retrieves the artifact from the cache or the storage and
+// returns the version it is cached with (empty if not cached)
+func loadArtifact(s storageProvider, identifier, deploymentID string, logger *log.Entry) (*deploymentArtifact, string, error) {
+	if artifactStore == nil {
+		artifact, err := downloadArtifact(s, identifier, deploymentID)
+		return artifact, "", err
+	}
+
+	version, err := s.GetDeploymentArtifactVersion(identifier, deploymentID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if version == "" {
+		logger.Debug("Storage did not report artifact version, skipping cache")
+		artifact, err := downloadArtifact(s, identifier, deploymentID)
+		return artifact, "", err
+	}
+
+	f, size, err := artifactStore.Get(identifier, deploymentID, version)
+	if err != nil {
+		return nil, "", fmt.Errorf("Unable to read artifact cache: %s", err)
+	}
+
+	if f != nil {
+		logger.WithField("version", version).Debug("Using cached artifact")
+		return &deploymentArtifact{File: f, Size: size}, version, nil
+	}
+
+	f, size, err = artifactStore.Store(identifier, deploymentID, version, artifactNaming.Extension(), func(w io.Writer) error {
+		return s.GetDeploymentArtifact(identifier, deploymentID, w)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The artifact just stored is kept even if it exceeds the cache size
+	if err := artifactStore.Evict(identifier, deploymentID, version); err != nil {
+		logger.WithError(err).Warn("Unable to evict old artifacts from cache")
+	}
+
+	return &deploymentArtifact{File: f, Size: size}, version, nil
+}
+
+// downloadArtifact spools the artifact into a temporary file to keep the
+// memory usage independent of the artifact size
+func downloadArtifact(s storageProvider, identifier, deploymentID string) (*deploymentArtifact, error) {
+	f, err := ioutil.TempFile(cfg.TempDir, "deploy-artifact-")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create temporary file: %s", err)
+	}
+
+	artifact := &deploymentArtifact{File: f, temporary: true}
+
+	if err := s.GetDeploymentArtifact(identifier, deploymentID, f); err != nil {
+		artifact.Close()
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		artifact.Close()
+		return nil, err
+	}
+
+	artifact.Size = stat.Size()
+	return artifact, nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const azureAPIVersion = "2020-10-02"
+
+func init() { registerStorageProvider(&storageAzure{}) }
+
+type storageAzure struct {
+	account   string
+	container string
+	endpoint  *url.URL
+	prefix    string
+
+	accountKey []byte
+	sasToken   url.Values
+
+	client *http.Client
+}
+
+type azureTime struct{ time.Time }
+
+func (a *azureTime) UnmarshalText(text []byte) (err error) {
+	a.Time, err = time.Parse(time.RFC1123, string(text))
+	return err
+}
+
+type azureEnumerationResults struct {
+	NextMarker string `xml:"NextMarker"`
+	Blobs      []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			LastModified  azureTime `xml:"Last-Modified"`
+			ContentLength int64     `xml:"Content-Length"`
+		} `xml:"Properties"`
+	} `xml:"Blobs>Blob"`
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageAzure) InitializeFromURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "az" {
+		return errInitializationNotPossible
+	}
+
+	s.account = u.Host
+
+	pathParts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	s.container = pathParts[0]
+	if s.container == "" {
+		return fmt.Errorf("No container given in URI %q", uri)
+	}
+
+	if len(pathParts) == 2 {
+		s.prefix = pathParts[1]
+	}
+	if len(s.prefix) > 0 && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix = s.prefix + "/"
+	}
+
+	endpoint := fmt.Sprintf("https://%s.blob.core.windows.net", s.account)
+
+	if connString := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); connString != "" {
+		if endpoint, err = s.parseConnectionString(connString, endpoint); err != nil {
+			return fmt.Errorf("Unable to parse connection string: %s", err)
+		}
+	}
+
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		if s.accountKey, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return fmt.Errorf("Unable to decode storage key: %s", err)
+		}
+	}
+
+	if sas := os.Getenv("AZURE_STORAGE_SAS_TOKEN"); sas != "" {
+		if s.sasToken, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return fmt.Errorf("Unable to parse SAS token: %s", err)
+		}
+	}
+
+	if e := u.Query().Get("endpoint"); e != "" {
+		endpoint = e
+	}
+
+	if s.endpoint, err = url.Parse(strings.TrimSuffix(endpoint, "/")); err != nil {
+		return fmt.Errorf("Unable to parse endpoint %q: %s", endpoint, err)
+	}
+
+	s.client = &http.Client{Timeout: 10 * time.Minute}
+	return nil
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s storageAzure) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	var (
+		deployments []deploymentCandidate
+		marker      string
+	)
+
+	for {
+		params := url.Values{
+			"restype":   []string{"container"},
+			"comp":      []string{"list"},
+			"delimiter": []string{"/"},
+			"prefix":    []string{s.prefix + artifactNaming.Prefix(identifier)},
+		}
+		if marker != "" {
+			params.Set("marker", marker)
+		}
+
+		resp, err := s.do(http.MethodGet, "", params, nil)
+		if err != nil {
+			return deploymentCandidate{}, err
+		}
+
+		result := azureEnumerationResults{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return deploymentCandidate{}, fmt.Errorf("Unable to decode blob listing: %s", err)
+		}
+
+		for _, blob := range result.Blobs {
+			deploymentID, ok := artifactNaming.ParseID(identifier, strings.TrimPrefix(blob.Name, s.prefix))
+			if !ok {
+				continue
+			}
+
+			deployments = append(deployments, deploymentCandidate{ID: deploymentID, Modified: blob.Properties.LastModified.Time})
+		}
+
+		if result.NextMarker == "" {
+			break
+		}
+		marker = result.NextMarker
+	}
+
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s storageAzure) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	err := s.GetObject(artifactNaming.Name(identifier, deploymentID), dst)
+	if err == errNoSuchObject {
+		err = errNoSuchDeployment
+	}
+	return err
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s storageAzure) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+artifactNaming.Name(identifier, deploymentID), nil, nil)
+	if err != nil {
+		if err == errNoSuchObject {
+			err = errNoSuchDeployment
+		}
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s storageAzure) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+artifactNaming.Name(identifier, deploymentID), nil, nil)
+	if err != nil {
+		if err == errNoSuchObject {
+			err = errNoSuchDeployment
+		}
+		return artifactChecksums{}, err
+	}
+	resp.Body.Close()
+
+	checksums := artifactChecksums{Size: resp.ContentLength}
+
+	if contentMD5 := resp.Header.Get("Content-MD5"); contentMD5 != "" {
+		if checksums.MD5, err = base64.StdEncoding.DecodeString(contentMD5); err != nil {
+			return checksums, fmt.Errorf("Unable to decode Content-MD5: %s", err)
+		}
+	}
+
+	return checksums, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s storageAzure) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+artifactNaming.Name(identifier, deploymentID), nil, nil)
+	if err != nil {
+		if err == errNoSuchObject {
+			err = errNoSuchDeployment
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return headerMetadata(resp.Header, "X-Ms-Meta-"), nil
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s storageAzure) GetObject(name string, dst io.Writer) error {
+	resp, err := s.do(http.MethodGet, s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s storageAzure) PutObject(name string, content []byte) error {
+	resp, err := s.do(http.MethodPut, s.prefix+name, nil, content)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s storageAzure) DeleteObject(name string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+name, nil, nil)
+	if err != nil && err != errNoSuchObject {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// String must return a string representation of the provider for debug logging
+func (s storageAzure) String() string {
+	return fmt.Sprintf("Azure provider at account %q, container %q with prefix %q", s.account, s.container, s.prefix)
+}
+
+// parseConnectionString reads credentials and endpoint from an Azure
+// storage connection string and returns the blob endpoint to use
+func (s *storageAzure) parseConnectionString(connString, endpoint string) (string, error) {
+	var (
+		err    error
+		fields = map[string]string{}
+	)
+
+	for _, part := range strings.Split(connString, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields[kv[0]] = kv[1]
+	}
+
+	if name := fields["AccountName"]; name != "" && name != s.account {
+		return "", fmt.Errorf("Connection string is for account %q, not %q", name, s.account)
+	}
+
+	if key := fields["AccountKey"]; key != "" {
+		if s.accountKey, err = base64.StdEncoding.DecodeString(key); err != nil {
+			return "", fmt.Errorf("Unable to decode account key: %s", err)
+		}
+	}
+
+	if sas := fields["SharedAccessSignature"]; sas != "" {
+		if s.sasToken, err = url.ParseQuery(strings.TrimPrefix(sas, "?")); err != nil {
+			return "", fmt.Errorf("Unable to parse SAS token: %s", err)
+		}
+	}
+
+	switch {
+	case fields["BlobEndpoint"] != "":
+		endpoint = fields["BlobEndpoint"]
+
+	case fields["EndpointSuffix"] != "":
+		proto := fields["DefaultEndpointsProtocol"]
+		if proto == "" {
+			proto = "https"
+		}
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", proto, s.account, fields["EndpointSuffix"])
+	}
+
+	return endpoint, nil
+}
+
+// do executes a request against the container and returns the response
+// if the status code indicates success. A missing blob is reported as
+// errNoSuchObject. If a body is given it is uploaded as block blob.
+func (s storageAzure) do(method, blob string, params url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.container
+	if blob != "" {
+		u.Path = u.Path + "/" + blob
+	}
+
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	if s.accountKey == nil {
+		for k, v := range s.sasToken {
+			query[k] = v
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+
+	if s.accountKey != nil {
+		s.signRequest(req)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && blob != "" {
+		return nil, errNoSuchObject
+	}
+
+	azErr := struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}{}
+	errBody, _ := ioutil.ReadAll(resp.Body)
+	if err := xml.Unmarshal(errBody, &azErr); err != nil || azErr.Code == "" {
+		return nil, fmt.Errorf("Azure request failed with status %d", resp.StatusCode)
+	}
+
+	return nil, fmt.Errorf("Azure request failed with status %d: %s (%s)", resp.StatusCode, strings.TrimSpace(azErr.Message), azErr.Code)
+}
+
+// signRequest adds a Shared Key authorization to the request
+func (s storageAzure) signRequest(req *http.Request) {
+	h := hmac.New(sha256.New, s.accountKey)
+	h.Write([]byte(azureStringToSign(req, s.account)))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"SharedKey %s:%s",
+		s.account, base64.StdEncoding.EncodeToString(h.Sum(nil)),
+	))
+}
+
+// azureStringToSign builds the Shared Key string to sign of the request
+// in the format used since version 2009-09-19
+func azureStringToSign(req *http.Request, account string) string {
+	headerNames := []string{}
+	for k := range req.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-ms-") {
+			headerNames = append(headerNames, strings.ToLower(k))
+		}
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := new(bytes.Buffer)
+	for _, k := range headerNames {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", k, strings.TrimSpace(req.Header.Get(k)))
+	}
+
+	canonicalResource := new(bytes.Buffer)
+	fmt.Fprintf(canonicalResource, "/%s%s", account, req.URL.EscapedPath())
+
+	query := req.URL.Query()
+	queryKeys := []string{}
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+
+	for _, k := range queryKeys {
+		values := query[k]
+		sort.Strings(values)
+		fmt.Fprintf(canonicalResource, "\n%s:%s", strings.ToLower(k), strings.Join(values, ","))
+	}
+
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	return strings.Join([]string{
+		req.Method,
+		"", // Content-Encoding
+		"", // Content-Language
+		contentLength,
+		"", // Content-MD5
+		"", // Content-Type
+		"", // Date
+		"", // If-Modified-Since
+		"", // If-Match
+		"", // If-None-Match
+		"", // If-Unmodified-Since
+		"", // Range
+		canonicalHeaders.String() + canonicalResource.String(),
+	}, "\n")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+// Examples of the Azure Storage documentation on authorizing requests
+// using Shared Key (format for version 2009-09-19 and later)
+const azureTestStringToSignHeaders = "GET\n" +
+	"\n" + // Content-Encoding
+	"\n" + // Content-Language
+	"\n" + // Content-Length
+	"\n" + // Content-MD5
+	"\n" + // Content-Type
+	"\n" + // Date
+	"\n" + // If-Modified-Since
+	"\n" + // If-Match
+	"\n" + // If-None-Match
+	"\n" + // If-Unmodified-Since
+	"\n" + // Range
+	"x-ms-date:Sun, 11 Oct 2009 21:49:13 GMT\n" +
+	"x-ms-version:2009-09-19\n"
+
+const azureTestStringToSign = azureTestStringToSignHeaders +
+	"/myaccount/mycontainer\n" +
+	"comp:metadata\n" +
+	"restype:container\n" +
+	"timeout:20"
+
+func newAzureTestRequest(t *testing.T, uri string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %s", err)
+	}
+	req.Header.Set("x-ms-date", "Sun, 11 Oct 2009 21:49:13 GMT")
+	req.Header.Set("x-ms-version", "2009-09-19")
+	return req
+}
+
+func TestAzureSharedKeyExample(t *testing.T) {
+	req := newAzureTestRequest(t, "https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata&timeout=20")
+
+	if stringToSign := azureStringToSign(req, "myaccount"); stringToSign != azureTestStringToSign {
+		t.Errorf("Unexpected string to sign:\n%s", stringToSign)
+	}
+
+	key := []byte("test key")
+	s := storageAzure{account: "myaccount", accountKey: key}
+	s.signRequest(req)
+
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(azureTestStringToSign))
+	if auth, expected := req.Header.Get("Authorization"), "SharedKey myaccount:"+base64.StdEncoding.EncodeToString(h.Sum(nil)); auth != expected {
+		t.Errorf("Expected authorization header %q, got %q", expected, auth)
+	}
+}
+
+func TestAzureCanonicalizedResource(t *testing.T) {
+	for uri, expected := range map[string]string{
+		"https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=metadata": "/myaccount/mycontainer\n" +
+			"comp:metadata\n" +
+			"restype:container",
+		"https://myaccount.blob.core.windows.net/mycontainer?restype=container&comp=list&include=snapshots&include=metadata&include=uncommittedblobs": "/myaccount/mycontainer\n" +
+			"comp:list\n" +
+			"include:metadata,snapshots,uncommittedblobs\n" +
+			"restype:container",
+		"https://myaccount.blob.core.windows.net/mycontainer/myblob": "/myaccount/mycontainer/myblob",
+	} {
+		if stringToSign := azureStringToSign(newAzureTestRequest(t, uri), "myaccount"); stringToSign != azureTestStringToSignHeaders+expected {
+			t.Errorf("Unexpected string to sign for %s:\n%s", uri, stringToSign)
+		}
+	}
+}
@@ -1,26 +1,66 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
+	"os"
 	"path"
-	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
-	"google.golang.org/api/iterator"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	raw "google.golang.org/api/storage/v1"
+	htransport "google.golang.org/api/transport/http"
 )
 
+const gcsDownloadHost = "storage.googleapis.com"
+
 func init() { registerStorageProvider(&storageGCS{}) }
 
 type storageGCS struct {
 	bucket     *storage.BucketHandle
 	bucketName string
 	client     *storage.Client
+	endpoint   string
 	prefix     string
+	raw        *raw.Service
+}
+
+// gcsEndpointTransport redirects all requests to the Google APIs to a
+// custom endpoint (for example an emulator)
+type gcsEndpointTransport struct {
+	base     http.RoundTripper
+	endpoint *url.URL
+}
+
+func (g gcsEndpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := new(http.Request)
+	*r = *req
+
+	u := *req.URL
+	if parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2); u.Host == gcsDownloadHost && len(parts) == 2 {
+		// Downloads use the XML API not supported by emulators, use the
+		// media download of the JSON API instead
+		u.Path = "/storage/v1/b/" + parts[0] + "/o/" + parts[1]
+		u.RawPath = "/storage/v1/b/" + url.PathEscape(parts[0]) + "/o/" + url.PathEscape(parts[1])
+
+		q := u.Query()
+		q.Set("alt", "media")
+		u.RawQuery = q.Encode()
+	}
+
+	u.Scheme = g.endpoint.Scheme
+	u.Host = g.endpoint.Host
+	r.URL = &u
+	r.Host = ""
+
+	return g.base.RoundTrip(r)
 }
 
 // InitializeFromURI retrieves the user input URI and must decide whether
@@ -43,7 +83,55 @@ func (s *storageGCS) InitializeFromURI(uri string) error {
 		s.prefix = s.prefix + "/"
 	}
 
-	s.client, err = storage.NewClient(context.Background())
+	opts := []option.ClientOption{option.WithScopes(storage.ScopeFullControl)}
+
+	params := u.Query()
+	endpoint := params.Get("endpoint")
+	unauthenticated := params.Get("unauthenticated") == "true"
+
+	if endpoint == "" && os.Getenv("STORAGE_EMULATOR_HOST") != "" {
+		// Emulators like fake-gcs-server do not require authentication
+		endpoint = os.Getenv("STORAGE_EMULATOR_HOST")
+		unauthenticated = true
+	}
+
+	switch {
+	case unauthenticated:
+		opts = append(opts, option.WithoutAuthentication())
+	case params.Get("credentials-file") != "":
+		opts = append(opts, option.WithCredentialsFile(params.Get("credentials-file")))
+	}
+
+	hc, _, err := htransport.NewClient(context.Background(), opts...)
+	if err != nil {
+		return err
+	}
+
+	if endpoint != "" {
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+
+		ep, err := url.Parse(endpoint)
+		if err != nil {
+			return fmt.Errorf("Unable to parse endpoint %q: %s", endpoint, err)
+		}
+
+		// The client uses fixed hosts for some requests (downloads, uploads)
+		// so all requests are redirected to the endpoint instead of only
+		// changing the API base path
+		hc.Transport = gcsEndpointTransport{base: hc.Transport, endpoint: ep}
+		s.endpoint = ep.String()
+	}
+
+	s.client, err = storage.NewClient(context.Background(), option.WithHTTPClient(hc))
+	if err != nil {
+		return err
+	}
+
+	// The listing uses the JSON API directly to request only the fields
+	// required to find the latest deployment
+	s.raw, err = raw.New(hc)
 	if err != nil {
 		return err
 	}
@@ -53,66 +141,178 @@ func (s *storageGCS) InitializeFromURI(uri string) error {
 }
 
 // GetLatestDeployment retrieves a software identifier and must return the
-// latest deployment ID for this software. In case a the identifier does not
-// exist an errNoDeploymentFound error must be returned.
-func (s storageGCS) GetLatestDeployment(identifier string) (string, error) {
-	deployments := []*storage.ObjectAttrs{}
-
-	it := s.bucket.Objects(context.Background(), &storage.Query{
-		Delimiter: "/",
-		Prefix:    s.prefix,
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s *storageGCS) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	var (
+		deployments = []deploymentCandidate{}
+		pages       int
+		start       = time.Now()
+	)
+
+	// Only objects of the identifier are listed (server-side prefix) and
+	// only the fields needed for the ordering are transferred. GCS has no
+	// bucket-level generation to detect changes without listing, so the
+	// listing is not cached between runs.
+	err := s.raw.Objects.List(s.bucketName).
+		Delimiter("/").
+		Prefix(s.prefix+artifactNaming.Prefix(identifier)).
+		Projection("noAcl").
+		Fields("nextPageToken", "items(name,updated)").
+		Pages(context.Background(), func(page *raw.Objects) error {
+			pages++
+
+			for _, obj := range page.Items {
+				deploymentID, ok := artifactNaming.ParseID(identifier, strings.TrimPrefix(obj.Name, s.prefix))
+				if !ok {
+					continue
+				}
+
+				updated, err := time.Parse(time.RFC3339Nano, obj.Updated)
+				if err != nil {
+					return fmt.Errorf("Unable to parse update time of %q: %s", obj.Name, err)
+				}
+
+				deployments = append(deployments, deploymentCandidate{ID: deploymentID, Modified: updated})
+			}
+
+			return nil
+		})
+
+	logger := log.WithFields(log.Fields{
+		"identifier": identifier,
+		"duration":   time.Since(start),
+		"pages":      pages,
+		"artifacts":  len(deployments),
 	})
 
-	for {
-		attr, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
+	if err != nil {
+		logger.WithError(err).Debug("Listing deployments failed")
+		return deploymentCandidate{}, err
+	}
 
-		if err != nil {
-			return "", err
-		}
+	logger.Debug("Listed deployments")
 
-		if strings.HasPrefix(attr.Name, path.Join(s.prefix, identifier)) && strings.HasSuffix(attr.Name, ".zip") {
-			deployments = append(deployments, attr)
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s *storageGCS) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	err := s.GetObject(artifactNaming.Name(identifier, deploymentID), dst)
+	if err == errNoSuchObject {
+		err = errNoSuchDeployment
+	}
+	return err
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s *storageGCS) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	attrs, err := s.bucket.Object(path.Join(s.prefix, artifactNaming.Name(identifier, deploymentID))).Attrs(context.Background())
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = errNoSuchDeployment
 		}
+		return "", err
 	}
 
-	if len(deployments) == 0 {
-		return "", errNoDeploymentFound
+	return strconv.FormatInt(attrs.Generation, 10), nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s *storageGCS) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	attrs, err := s.bucket.Object(path.Join(s.prefix, artifactNaming.Name(identifier, deploymentID))).Attrs(context.Background())
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = errNoSuchDeployment
+		}
+		return artifactChecksums{}, err
 	}
 
-	sort.Slice(deployments, func(i, j int) bool {
-		return deployments[i].Updated.Before(deployments[j].Updated)
-	})
+	return artifactChecksums{
+		Size:   attrs.Size,
+		MD5:    attrs.MD5,
+		CRC32C: crc32cChecksum(attrs.CRC32C),
+	}, nil
+}
 
-	deploymentID := deployments[len(deployments)-1].Name
-	deploymentID = strings.TrimPrefix(deploymentID, path.Join(s.prefix, identifier))
-	deploymentID = strings.TrimSuffix(deploymentID, ".zip")
-	return deploymentID, nil
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s *storageGCS) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	attrs, err := s.bucket.Object(path.Join(s.prefix, artifactNaming.Name(identifier, deploymentID))).Attrs(context.Background())
+	if err != nil {
+		if err == storage.ErrObjectNotExist {
+			err = errNoSuchDeployment
+		}
+		return nil, err
+	}
+
+	return attrs.Metadata, nil
 }
 
-// GetDeploymentArtifact retrieves an software identifier and a deployment
-// ID and must return an io.ReaderAt containing the ZIP-file of the artifact
-// and the size of the ZIP-file. In case there is no artifact for the given
-// identifier and deploymentID an errNoSuchDeployment error must be returned.
-func (s storageGCS) GetDeploymentArtifact(identifier, deploymentID string) (io.ReaderAt, int64, error) {
-	obj := s.bucket.Object(path.Join(s.prefix, identifier+deploymentID+".zip"))
-	r, err := obj.NewReader(context.Background())
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s *storageGCS) GetObject(name string, dst io.Writer) error {
+	r, err := s.bucket.Object(path.Join(s.prefix, name)).NewReader(context.Background())
 	if err != nil {
-		return nil, 0, err
+		if err == storage.ErrObjectNotExist {
+			err = errNoSuchObject
+		}
+		return err
 	}
 	defer r.Close()
 
-	buf := new(bytes.Buffer)
-	if _, err := io.Copy(buf, r); err != nil {
-		return nil, 0, err
+	_, err = io.Copy(dst, r)
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s *storageGCS) PutObject(name string, content []byte) error {
+	w := s.bucket.Object(path.Join(s.prefix, name)).NewWriter(context.Background())
+	if _, err := w.Write(content); err != nil {
+		w.Close()
+		return err
 	}
+	return w.Close()
+}
 
-	return bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s *storageGCS) DeleteObject(name string) error {
+	err := s.bucket.Object(path.Join(s.prefix, name)).Delete(context.Background())
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	return nil
 }
 
 // String must return a string representation of the provider for debug logging
-func (s storageGCS) String() string {
+func (s *storageGCS) String() string {
+	if s.endpoint != "" {
+		return fmt.Sprintf("GCE provider at bucket %q with prefix %q using endpoint %q", s.bucketName, s.prefix, s.endpoint)
+	}
 	return fmt.Sprintf("GCE provider at bucket %q with prefix %q", s.bucketName, s.prefix)
 }
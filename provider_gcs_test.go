@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type gcsTestObject struct {
+	content  string
+	updated  time.Time
+	metadata map[string]string
+}
+
+// newGCSTestServer emulates the parts of the GCS JSON API used by the
+// provider, listings are returned with one object per page
+func newGCSTestServer(t *testing.T, objects map[string]gcsTestObject, listings *[]string) *httptest.Server {
+	const base = "/storage/v1/b/test-bucket/o"
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == base:
+			prefix := r.URL.Query().Get("prefix")
+			*listings = append(*listings, prefix+" "+r.URL.Query().Get("fields"))
+
+			names := []string{}
+			for name := range objects {
+				if strings.HasPrefix(name, prefix) {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+
+			page := map[string]interface{}{"items": []interface{}{}}
+			for i, name := range names {
+				if r.URL.Query().Get("pageToken") != "" && r.URL.Query().Get("pageToken") != name {
+					continue
+				}
+				page["items"] = []interface{}{map[string]string{"name": name, "updated": objects[name].updated.Format(time.RFC3339Nano)}}
+				if i+1 < len(names) {
+					page["nextPageToken"] = names[i+1]
+				}
+				break
+			}
+			json.NewEncoder(w).Encode(page)
+
+		case strings.HasPrefix(r.URL.Path, base+"/"):
+			name := strings.TrimPrefix(r.URL.Path, base+"/")
+			obj, ok := objects[name]
+			if !ok {
+				http.Error(w, `{"error": {"code": 404, "message": "Not Found"}}`, http.StatusNotFound)
+				return
+			}
+
+			if r.URL.Query().Get("alt") == "media" {
+				w.Write([]byte(obj.content))
+				return
+			}
+
+			sum := md5.Sum([]byte(obj.content))
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"bucket":     "test-bucket",
+				"name":       name,
+				"generation": "1234",
+				"size":       strconv.Itoa(len(obj.content)),
+				"md5Hash":    base64.StdEncoding.EncodeToString(sum[:]),
+				"metadata":   obj.metadata,
+				"updated":    obj.updated.Format(time.RFC3339Nano),
+			})
+
+		default:
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestGCSStorage(t *testing.T) {
+	now := time.Now()
+	listings := []string{}
+	srv := newGCSTestServer(t, map[string]gcsTestObject{
+		"deploy/default1.zip":     {content: "first", updated: now.Add(-2 * time.Hour)},
+		"deploy/default2.zip":     {content: "second", updated: now.Add(-time.Hour), metadata: map[string]string{"commit": "abc"}},
+		"deploy/default2.zip.sig": {updated: now},
+		"deploy/other3.zip":       {content: "other", updated: now},
+	}, &listings)
+	defer srv.Close()
+
+	s := &storageGCS{}
+	if err := s.InitializeFromURI("gs://test-bucket/deploy?unauthenticated=true&endpoint=" + srv.URL); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	latest, err := s.GetLatestDeployment("default")
+	if err != nil || latest.ID != "2" {
+		t.Fatalf("Expected deployment 2, got %q (%v)", latest.ID, err)
+	}
+
+	// Listed server-side by prefix (one request per page) requesting only the name and update time
+	if len(listings) != 3 || listings[0] != "deploy/default nextPageToken,items(name,updated)" {
+		t.Errorf("Unexpected listing requests %q", listings)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.GetDeploymentArtifact("default", "2", buf); err != nil || buf.String() != "second" {
+		t.Errorf("Unexpected artifact %q (%v)", buf.String(), err)
+	}
+
+	if version, err := s.GetDeploymentArtifactVersion("default", "2"); err != nil || version != "1234" {
+		t.Errorf("Unexpected version %q (%v)", version, err)
+	}
+
+	sum := md5.Sum([]byte("second"))
+	if checksums, err := s.GetDeploymentArtifactChecksums("default", "2"); err != nil || checksums.Size != 6 || !bytes.Equal(checksums.MD5, sum[:]) {
+		t.Errorf("Unexpected checksums %+v (%v)", checksums, err)
+	}
+
+	if metadata, err := s.GetDeploymentArtifactMetadata("default", "2"); err != nil || metadata["commit"] != "abc" {
+		t.Errorf("Unexpected metadata %v (%v)", metadata, err)
+	}
+
+	if err := s.GetDeploymentArtifact("default", "3", buf); err != errNoSuchDeployment {
+		t.Errorf("Expected errNoSuchDeployment for missing deployment, got %v", err)
+	}
+
+	if err := s.GetObject("default.latest", buf); err != errNoSuchObject {
+		t.Errorf("Expected errNoSuchObject for missing object, got %v", err)
+	}
+
+	if _, err := s.GetLatestDeployment("unknown"); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound for unknown identifier, got %v", err)
+	}
+}
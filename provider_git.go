@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	gitCommandTimeout = 10 * time.Minute
+	gitMirrorDir      = ".git-mirrors"
+	gitMirrorDirPerm  = 0700
+	gitDefaultPattern = "{identifier}*"
+	gitIdentifier     = "{identifier}"
+
+	// All requests of a run (latest pointer, pin, tags, artifact) are
+	// served from the same state of the mirror instead of fetching it for
+	// every request
+	gitMirrorMaxAge = 30 * time.Second
+)
+
+func init() { registerStorageProvider(&storageGit{}) }
+
+type storageGit struct {
+	branch   string
+	pattern  string
+	remote   string
+	repoPath string
+
+	mirrorLock    sync.Mutex
+	mirrorUpdated time.Time
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageGit) InitializeFromURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(u.Scheme, "git+") {
+		return errInitializationNotPossible
+	}
+
+	params := u.Query()
+	u.RawQuery = ""
+	u.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+
+	s.branch = params.Get("branch")
+	s.pattern = params.Get("pattern")
+	if s.pattern == "" {
+		s.pattern = gitDefaultPattern
+	}
+
+	if u.Scheme == "file" {
+		// Local repositories can be used directly without mirroring them
+		s.remote = ""
+		s.repoPath = u.Path
+		return nil
+	}
+
+	s.remote = u.String()
+
+	cacheDir := params.Get("cache-dir")
+	switch {
+	case cacheDir != "":
+	case cfg.DeploymentRoot != "":
+		cacheDir = path.Join(cfg.DeploymentRoot, gitMirrorDir)
+	default:
+		// Without a persistent location the mirrors are kept in a directory
+		// per user inside the temp dir which is reused by the next start
+		// instead of cloning into a new directory every time
+		tempDir := cfg.TempDir
+		if tempDir == "" {
+			tempDir = os.TempDir()
+		}
+		cacheDir = path.Join(tempDir, fmt.Sprintf("deploy-git-mirrors-%d", os.Getuid()))
+	}
+
+	if err := preparePrivateDir(cacheDir); err != nil {
+		return err
+	}
+
+	remoteHash := sha256.Sum256([]byte(s.remote))
+	s.repoPath = path.Join(cacheDir, hex.EncodeToString(remoteHash[:8])+".git")
+
+	return nil
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s *storageGit) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	if err := s.updateMirror(); err != nil {
+		return deploymentCandidate{}, err
+	}
+
+	if s.branch != "" {
+		branch := strings.Replace(s.branch, gitIdentifier, identifier, -1)
+		out, err := s.git("log", "-1", "--format=%H %ct", "refs/heads/"+branch, "--")
+		if err != nil {
+			return deploymentCandidate{}, errNoDeploymentFound
+		}
+
+		fields := strings.Fields(string(out))
+		if len(fields) != 2 {
+			return deploymentCandidate{}, fmt.Errorf("Unexpected output of git log: %q", out)
+		}
+
+		committed, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return deploymentCandidate{}, fmt.Errorf("Unable to parse commit date of branch %q: %s", branch, err)
+		}
+		return deploymentCandidate{ID: fields[0], Modified: time.Unix(committed, 0)}, nil
+	}
+
+	pattern := strings.Replace(s.pattern, gitIdentifier, identifier, -1)
+	out, err := s.git("for-each-ref", "--format=%(creatordate:unix) %(refname:short)", "refs/tags/"+pattern)
+	if err != nil {
+		return deploymentCandidate{}, err
+	}
+
+	deployments := []deploymentCandidate{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		created, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			return deploymentCandidate{}, fmt.Errorf("Unable to parse creation date of tag %q: %s", fields[1], err)
+		}
+
+		if validateDeploymentID(fields[1]) != nil {
+			// Tags like "release/1.0" can not be used as deployment ID
+			continue
+		}
+
+		deployments = append(deployments, deploymentCandidate{ID: fields[1], Modified: time.Unix(created, 0)})
+	}
+
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s *storageGit) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	if deploymentID == "" || strings.HasPrefix(deploymentID, "-") {
+		return errNoSuchDeployment
+	}
+
+	if _, err := s.git("rev-parse", "--verify", "--quiet", deploymentID+"^{commit}"); err != nil {
+		return errNoSuchDeployment
+	}
+
+	return s.runGit(s.repoPath, dst, "archive", "--format=zip", deploymentID)
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s *storageGit) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	if deploymentID == "" || strings.HasPrefix(deploymentID, "-") {
+		return "", errNoSuchDeployment
+	}
+
+	out, err := s.git("rev-parse", "--verify", "--quiet", deploymentID+"^{commit}")
+	if err != nil {
+		return "", errNoSuchDeployment
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s *storageGit) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	// The archive is generated on the fly so there are no checksums
+	// to verify it against
+	if _, err := s.GetDeploymentArtifactVersion(identifier, deploymentID); err != nil {
+		return artifactChecksums{}, err
+	}
+
+	return artifactChecksums{}, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s *storageGit) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	return fetchMetadataSidecar(s, identifier, deploymentID)
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s *storageGit) GetObject(name string, dst io.Writer) error {
+	if err := s.updateMirror(); err != nil {
+		return err
+	}
+
+	// Branches per identifier have no common tree to read objects from
+	rev := "HEAD"
+	if s.branch != "" && !strings.Contains(s.branch, gitIdentifier) {
+		rev = "refs/heads/" + s.branch
+	}
+
+	if _, err := s.git("cat-file", "-e", rev+":"+name); err != nil {
+		return errNoSuchObject
+	}
+
+	return s.runGit(s.repoPath, dst, "cat-file", "blob", rev+":"+name)
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s *storageGit) PutObject(name string, content []byte) error {
+	return errNotSupported
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s *storageGit) DeleteObject(name string) error {
+	return errNotSupported
+}
+
+// String must return a string representation of the provider for debug logging
+func (s *storageGit) String() string {
+	if s.remote == "" {
+		return fmt.Sprintf("Git provider at local repository %q", s.repoPath)
+	}
+	return fmt.Sprintf("Git provider for remote %q mirrored to %q", s.remote, s.repoPath)
+}
+
+// updateMirror creates or updates the local mirror of the remote
+// repository unless it was updated within gitMirrorMaxAge. For local
+// repositories this is a no-op.
+func (s *storageGit) updateMirror() error {
+	if s.remote == "" {
+		return nil
+	}
+
+	s.mirrorLock.Lock()
+	defer s.mirrorLock.Unlock()
+
+	if time.Since(s.mirrorUpdated) < gitMirrorMaxAge {
+		return nil
+	}
+
+	var err error
+	if _, serr := os.Stat(s.repoPath); serr == nil {
+		_, err = s.git("remote", "update", "--prune")
+	} else {
+		err = s.cloneMirror()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.mirrorUpdated = time.Now()
+	return nil
+}
+
+// cloneMirror clones the remote repository next to the mirror and moves
+// it into place afterwards so an interrupted clone is not picked up as
+// the mirror by the next start
+func (s *storageGit) cloneMirror() error {
+	tmp, err := ioutil.TempDir(path.Dir(s.repoPath), path.Base(s.repoPath)+".clone-")
+	if err != nil {
+		return fmt.Errorf("Unable to create mirror directory: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := s.runGit("", ioutil.Discard, "clone", "--mirror", "--quiet", s.remote, tmp); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, s.repoPath); err != nil {
+		return fmt.Errorf("Unable to move mirror into place: %s", err)
+	}
+
+	return nil
+}
+
+// preparePrivateDir creates the directory accessible only by the current
+// user and refuses to use an existing directory owned by another user as
+// its content (for example hooks inside a mirror) could be manipulated
+func preparePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, gitMirrorDirPerm); err != nil {
+		return fmt.Errorf("Unable to create mirror directory: %s", err)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("Unable to access mirror directory: %s", err)
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("Mirror directory %q is owned by uid %d instead of the current user", dir, st.Uid)
+	}
+
+	return nil
+}
+
+func (s *storageGit) git(args ...string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := s.runGit(s.repoPath, buf, args...)
+	return buf.Bytes(), err
+}
+
+func (s *storageGit) runGit(dir string, stdout io.Writer, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gitCommandTimeout)
+	defer cancel()
+
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+
+	stderr := new(bytes.Buffer)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Command \"git %s\" failed: %s (%s)", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"testing"
+	"time"
+)
+
+func runTestGit(t *testing.T, dir string, args ...string) {
+	cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v failed: %s: %s", args, err, out)
+	}
+}
+
+func TestGitMirrorFetchedOncePerRun(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "deploy-git-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := path.Join(dir, "remote")
+	if err := os.Mkdir(remote, 0700); err != nil {
+		t.Fatalf("Unable to create remote: %s", err)
+	}
+	runTestGit(t, remote, "init", "--quiet")
+	runTestGit(t, remote, "commit", "--quiet", "--allow-empty", "-m", "first")
+	runTestGit(t, remote, "tag", "v1")
+
+	s := &storageGit{pattern: "v*", remote: remote, repoPath: path.Join(dir, "mirror.git")}
+
+	latest, err := s.GetLatestDeployment("default")
+	if err != nil || latest.ID != "v1" {
+		t.Fatalf("Expected v1, got %q (%v)", latest.ID, err)
+	}
+
+	runTestGit(t, remote, "commit", "--quiet", "--allow-empty", "-m", "second")
+	runTestGit(t, remote, "tag", "v2")
+
+	// Requests of the same run use the existing state of the mirror
+	if latest, err = s.GetLatestDeployment("default"); err != nil || latest.ID != "v1" {
+		t.Errorf("Expected mirror not to be fetched again, got %q (%v)", latest.ID, err)
+	}
+
+	s.mirrorUpdated = time.Now().Add(-gitMirrorMaxAge)
+	if latest, err = s.GetLatestDeployment("default"); err != nil || latest.ID != "v2" {
+		t.Errorf("Expected v2 after the mirror expired, got %q (%v)", latest.ID, err)
+	}
+}
+
+func TestPreparePrivateDirRefusesForeignOwner(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Changing the owner requires root")
+	}
+
+	dir, err := ioutil.TempDir("", "deploy-git-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := preparePrivateDir(dir); err != nil {
+		t.Fatalf("Own directory was refused: %s", err)
+	}
+
+	if err := os.Chown(dir, 65534, 65534); err != nil {
+		t.Fatalf("Unable to change owner: %s", err)
+	}
+
+	if err := preparePrivateDir(dir); err == nil {
+		t.Error("Directory owned by another user was accepted")
+	}
+}
+
+func TestGitIdentifier(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "deploy-git-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	runTestGit(t, dir, "init", "--quiet")
+	runTestGit(t, dir, "commit", "--quiet", "--allow-empty", "-m", "default")
+	runTestGit(t, dir, "tag", "default-1")
+	runTestGit(t, dir, "branch", "deploy/default")
+	runTestGit(t, dir, "commit", "--quiet", "--allow-empty", "-m", "other")
+	runTestGit(t, dir, "tag", "other-1")
+	runTestGit(t, dir, "branch", "deploy/other")
+
+	s := &storageGit{}
+	if err := s.InitializeFromURI("git+file://" + dir); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	// The default pattern only matches the tags of the identifier
+	for identifier, expected := range map[string]string{"default": "default-1", "other": "other-1"} {
+		if latest, err := s.GetLatestDeployment(identifier); err != nil || latest.ID != expected {
+			t.Errorf("%s: Expected %s, got %q (%v)", identifier, expected, latest.ID, err)
+		}
+	}
+	if _, err := s.GetLatestDeployment("unknown"); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound for unknown identifier, got %v", err)
+	}
+
+	if err := s.InitializeFromURI("git+file://" + dir + "?branch=deploy/{identifier}"); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	for identifier, tag := range map[string]string{"default": "default-1", "other": "other-1"} {
+		expected, err := s.GetDeploymentArtifactVersion(identifier, tag)
+		if err != nil {
+			t.Fatalf("Unable to resolve %s: %s", tag, err)
+		}
+		if latest, err := s.GetLatestDeployment(identifier); err != nil || latest.ID != expected {
+			t.Errorf("%s: Expected head of its branch %s, got %q (%v)", identifier, expected, latest.ID, err)
+		}
+	}
+	if _, err := s.GetLatestDeployment("unknown"); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound for unknown branch, got %v", err)
+	}
+}
+
+func TestGitMirrorReused(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	dir, err := ioutil.TempDir("", "deploy-git-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(root, tempDir string) { cfg.DeploymentRoot, cfg.TempDir = root, tempDir }(cfg.DeploymentRoot, cfg.TempDir)
+	cfg.DeploymentRoot, cfg.TempDir = "", path.Join(dir, "tmp")
+
+	remote := path.Join(dir, "remote")
+	if err := os.Mkdir(remote, 0700); err != nil {
+		t.Fatalf("Unable to create remote: %s", err)
+	}
+	runTestGit(t, remote, "init", "--quiet")
+	runTestGit(t, remote, "commit", "--quiet", "--allow-empty", "-m", "first")
+	runTestGit(t, remote, "tag", "default1")
+
+	// Two starts without deployment root share one mirror
+	for i := 0; i < 2; i++ {
+		s := &storageGit{}
+		if err := s.InitializeFromURI("git+ssh://localhost" + remote); err != nil {
+			t.Fatalf("Initialization failed: %s", err)
+		}
+		// Mirror the local repository instead of connecting through SSH
+		s.remote = remote
+
+		if latest, err := s.GetLatestDeployment("default"); err != nil || latest.ID != "default1" {
+			t.Fatalf("Expected default1, got %q (%v)", latest.ID, err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(cfg.TempDir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected one mirror directory, got %v (%v)", entries, err)
+	}
+	if mirrors, err := ioutil.ReadDir(path.Join(cfg.TempDir, entries[0].Name())); err != nil || len(mirrors) != 1 {
+		t.Errorf("Expected one mirror, got %v (%v)", mirrors, err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const httpDefaultIndexName = "index.json"
+
+func init() { registerStorageProvider(&storageHTTP{}) }
+
+// httpIndex contains a list of deployments for each software identifier
+//
+//	{
+//	  "default": [
+//	    { "id": "xyz123", "timestamp": "2018-05-02T10:00:00Z" }
+//	  ]
+//	}
+type httpIndex map[string][]struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type storageHTTP struct {
+	baseURL   *url.URL
+	client    *http.Client
+	indexName string
+
+	index             httpIndex
+	indexETag         string
+	indexLastModified string
+	indexLock         sync.Mutex
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageHTTP) InitializeFromURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errInitializationNotPossible
+	}
+
+	s.indexName = u.Query().Get("index")
+	if s.indexName == "" {
+		s.indexName = httpDefaultIndexName
+	}
+
+	u.RawQuery = ""
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path = u.Path + "/"
+	}
+	s.baseURL = u
+
+	s.client = &http.Client{Timeout: 10 * time.Minute}
+	return nil
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s *storageHTTP) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	index, err := s.fetchIndex()
+	if err != nil {
+		return deploymentCandidate{}, err
+	}
+
+	deployments := []deploymentCandidate{}
+	for _, d := range index[identifier] {
+		if validateDeploymentID(d.ID) != nil {
+			continue
+		}
+		deployments = append(deployments, deploymentCandidate{ID: d.ID, Modified: d.Timestamp})
+	}
+
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s *storageHTTP) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	err := s.GetObject(artifactNaming.Name(identifier, deploymentID), dst)
+	if err == errNoSuchObject {
+		err = errNoSuchDeployment
+	}
+	return err
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s *storageHTTP) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	resp, err := s.headArtifact(identifier, deploymentID)
+	if err != nil {
+		return "", err
+	}
+
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		return etag, nil
+	}
+	return resp.Header.Get("Last-Modified"), nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s *storageHTTP) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	resp, err := s.headArtifact(identifier, deploymentID)
+	if err != nil {
+		return artifactChecksums{}, err
+	}
+
+	if resp.Header.Get("Content-Encoding") != "" || resp.ContentLength < 0 {
+		// Length of the transferred content, not of the artifact
+		return artifactChecksums{}, nil
+	}
+
+	return artifactChecksums{Size: resp.ContentLength}, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s *storageHTTP) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	return fetchMetadataSidecar(s, identifier, deploymentID)
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s *storageHTTP) GetObject(name string, dst io.Writer) error {
+	resp, err := s.client.Get(s.resolve(name))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Fine, continue
+	case http.StatusNotFound:
+		return errNoSuchObject
+	default:
+		return fmt.Errorf("Unexpected HTTP status %d fetching %q", resp.StatusCode, name)
+	}
+
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s *storageHTTP) PutObject(name string, content []byte) error {
+	return errNotSupported
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s *storageHTTP) DeleteObject(name string) error {
+	return errNotSupported
+}
+
+// String must return a string representation of the provider for debug logging
+func (s *storageHTTP) String() string {
+	return fmt.Sprintf("HTTP provider at %q with index %q", s.baseURL.String(), s.indexName)
+}
+
+// headArtifact requests the headers of the artifact
+func (s *storageHTTP) headArtifact(identifier, deploymentID string) (*http.Response, error) {
+	resp, err := s.client.Head(s.resolve(artifactNaming.Name(identifier, deploymentID)))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		return nil, errNoSuchDeployment
+	default:
+		return nil, fmt.Errorf("Unexpected HTTP status %d fetching artifact", resp.StatusCode)
+	}
+}
+
+// fetchIndex retrieves the index document using a conditional request
+// and returns the cached version if the server reports no modification
+func (s *storageHTTP) fetchIndex() (httpIndex, error) {
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, s.resolve(s.indexName), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.index != nil {
+		if s.indexETag != "" {
+			req.Header.Set("If-None-Match", s.indexETag)
+		}
+		if s.indexLastModified != "" {
+			req.Header.Set("If-Modified-Since", s.indexLastModified)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// Fine, continue
+	case http.StatusNotModified:
+		return s.index, nil
+	case http.StatusNotFound:
+		return nil, errNoDeploymentFound
+	default:
+		return nil, fmt.Errorf("Unexpected HTTP status %d fetching index", resp.StatusCode)
+	}
+
+	index := httpIndex{}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		return nil, fmt.Errorf("Unable to decode index: %s", err)
+	}
+
+	s.index = index
+	s.indexETag = resp.Header.Get("ETag")
+	s.indexLastModified = resp.Header.Get("Last-Modified")
+
+	return s.index, nil
+}
+
+func (s *storageHTTP) resolve(name string) string {
+	return s.baseURL.ResolveReference(&url.URL{Path: name}).String()
+}
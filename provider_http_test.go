@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPStorage(t *testing.T) {
+	files := map[string]string{
+		"/deploy/index.json": `{
+			"default": [
+				{"id": "1", "timestamp": "2018-05-02T10:00:00Z"},
+				{"id": "2", "timestamp": "2018-05-02T11:00:00Z"},
+				{"id": "../3", "timestamp": "2018-05-02T12:00:00Z"}
+			],
+			"other": [{"id": "4", "timestamp": "2018-05-02T13:00:00Z"}]
+		}`,
+		"/deploy/default2.zip":      "second",
+		"/deploy/default2.zip.json": `{"commit": "abc", "build": 42}`,
+		"/deploy/default.latest":    "1",
+	}
+	indexRequests, notModified := 0, 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/deploy/broken.zip" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		if r.URL.Path == "/deploy/index.json" {
+			indexRequests++
+			if r.Header.Get("If-None-Match") == `"index-v1"` {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"index-v1"`)
+		} else {
+			w.Header().Set("ETag", `"`+r.URL.Path+`"`)
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	s := &storageHTTP{}
+	if err := s.InitializeFromURI(srv.URL + "/deploy"); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	// Invalid deployment IDs inside the index are ignored
+	for i := 0; i < 2; i++ {
+		latest, err := s.GetLatestDeployment("default")
+		if err != nil || latest.ID != "2" {
+			t.Fatalf("Expected deployment 2, got %q (%v)", latest.ID, err)
+		}
+	}
+
+	// The unmodified index is served from memory
+	if indexRequests != 2 || notModified != 1 {
+		t.Errorf("Expected one conditional request, got %d requests (%d not modified)", indexRequests, notModified)
+	}
+
+	if _, err := s.GetLatestDeployment("unknown"); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound for unknown identifier, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.GetDeploymentArtifact("default", "2", buf); err != nil || buf.String() != "second" {
+		t.Errorf("Unexpected artifact %q (%v)", buf.String(), err)
+	}
+
+	if version, err := s.GetDeploymentArtifactVersion("default", "2"); err != nil || version != `"/deploy/default2.zip"` {
+		t.Errorf("Unexpected version %q (%v)", version, err)
+	}
+
+	if checksums, err := s.GetDeploymentArtifactChecksums("default", "2"); err != nil || checksums.Size != 6 {
+		t.Errorf("Unexpected checksums %+v (%v)", checksums, err)
+	}
+
+	if metadata, err := s.GetDeploymentArtifactMetadata("default", "2"); err != nil || metadata["commit"] != "abc" || metadata["build"] != "42" {
+		t.Errorf("Unexpected metadata %v (%v)", metadata, err)
+	}
+
+	buf.Reset()
+	if err := s.GetObject("default.latest", buf); err != nil || buf.String() != "1" {
+		t.Errorf("Unexpected pointer %q (%v)", buf.String(), err)
+	}
+
+	if err := s.GetDeploymentArtifact("default", "1", buf); err != errNoSuchDeployment {
+		t.Errorf("Expected errNoSuchDeployment for missing artifact, got %v", err)
+	}
+
+	if _, err := s.GetDeploymentArtifactVersion("default", "1"); err != errNoSuchDeployment {
+		t.Errorf("Expected errNoSuchDeployment for missing artifact, got %v", err)
+	}
+
+	if err := s.GetObject("other.latest", buf); err != errNoSuchObject {
+		t.Errorf("Expected errNoSuchObject for missing object, got %v", err)
+	}
+
+	if err := s.GetObject("broken.zip", buf); err == nil || err == errNoSuchObject {
+		t.Errorf("Expected server error to be reported, got %v", err)
+	}
+
+	if err := s.PutObject("default.latest", []byte("2")); err != errNotSupported {
+		t.Errorf("Expected errNotSupported for writing, got %v", err)
+	}
+}
@@ -1,15 +1,12 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
-	"sort"
-	"strings"
 )
 
 func init() {
@@ -39,57 +36,130 @@ func (s *storageLocal) InitializeFromURI(uri string) error {
 }
 
 // GetLatestDeployment retrieves a software identifier and must return the
-// latest deployment ID for this software. In case a the identifier does not
-// exist an errNoDeploymentFound error must be returned.
-func (s storageLocal) GetLatestDeployment(identifier string) (string, error) {
-	files, err := ioutil.ReadDir(s.path)
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s storageLocal) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	dir := artifactNaming.Dir(identifier)
+
+	files, err := ioutil.ReadDir(path.Join(s.path, dir))
 	if err != nil {
-		return "", err
+		if os.IsNotExist(err) {
+			return deploymentCandidate{}, errNoDeploymentFound
+		}
+		return deploymentCandidate{}, err
 	}
 
-	deployments := []os.FileInfo{}
+	deployments := []deploymentCandidate{}
 
 	for _, f := range files {
 		if f.IsDir() {
 			continue
 		}
 
-		if !strings.HasPrefix(f.Name(), identifier) || !strings.HasSuffix(f.Name(), ".zip") {
+		deploymentID, ok := artifactNaming.ParseID(identifier, path.Join(dir, f.Name()))
+		if !ok {
 			continue
 		}
 
-		deployments = append(deployments, f)
+		deployments = append(deployments, deploymentCandidate{ID: deploymentID, Modified: f.ModTime()})
 	}
 
-	if len(deployments) == 0 {
-		return "", errNoDeploymentFound
-	}
+	return selectLatestDeployment(deployments)
+}
 
-	sort.Slice(deployments, func(i, j int) bool {
-		return deployments[i].ModTime().Before(deployments[j].ModTime())
-	})
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s storageLocal) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	err := s.GetObject(artifactNaming.Name(identifier, deploymentID), dst)
+	if err == errNoSuchObject {
+		err = errNoSuchDeployment
+	}
+	return err
+}
 
-	lastDeployment := deployments[len(deployments)-1].Name()
-	lastDeployment = strings.TrimSuffix(lastDeployment, ".zip")
-	lastDeployment = strings.TrimPrefix(lastDeployment, identifier)
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s storageLocal) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	stat, err := os.Stat(path.Join(s.path, artifactNaming.Name(identifier, deploymentID)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errNoSuchDeployment
+		}
+		return "", err
+	}
 
-	return lastDeployment, nil
+	return fmt.Sprintf("%d-%d", stat.Size(), stat.ModTime().UnixNano()), nil
 }
 
-// GetDeploymentArtifact retrieves an software identifier and a deployment
-// ID and must return an io.ReaderAt containing the ZIP-file of the artifact
-// and the size of the ZIP-file. In case there is no artifact for the given
-// identifier and deploymentID an errNoSuchDeployment error must be returned.
-func (s storageLocal) GetDeploymentArtifact(identifier, deploymentID string) (io.ReaderAt, int64, error) {
-	rawZip, err := ioutil.ReadFile(path.Join(s.path, identifier+deploymentID+".zip"))
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s storageLocal) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	stat, err := os.Stat(path.Join(s.path, artifactNaming.Name(identifier, deploymentID)))
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = errNoSuchDeployment
 		}
-		return nil, 0, err
+		return artifactChecksums{}, err
 	}
 
-	return bytes.NewReader(rawZip), int64(len(rawZip)), nil
+	return artifactChecksums{Size: stat.Size()}, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s storageLocal) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	return fetchMetadataSidecar(&s, identifier, deploymentID)
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s storageLocal) GetObject(name string, dst io.Writer) error {
+	f, err := os.Open(path.Join(s.path, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = errNoSuchObject
+		}
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dst, f)
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s storageLocal) PutObject(name string, content []byte) error {
+	return ioutil.WriteFile(path.Join(s.path, name), content, 0644)
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s storageLocal) DeleteObject(name string) error {
+	if err := os.Remove(path.Join(s.path, name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 // String must return a string representation of the provider for debug logging
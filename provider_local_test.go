@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeTestArtifact(t *testing.T, dir, name, content string, modified time.Time) {
+	if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %s", name, err)
+	}
+	if err := os.Chtimes(path.Join(dir, name), modified, modified); err != nil {
+		t.Fatalf("Unable to set modification time of %s: %s", name, err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-local-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	writeTestArtifact(t, dir, "default1.zip", "first", now.Add(-2*time.Hour))
+	writeTestArtifact(t, dir, "default2.zip", "second", now.Add(-time.Hour))
+	// Auxiliary objects and artifacts of other identifiers modified later
+	writeTestArtifact(t, dir, "default2.zip.sig", "", now)
+	writeTestArtifact(t, dir, "default.latest", "1", now)
+	writeTestArtifact(t, dir, "default-admin3.zip", "admin", now)
+
+	s := &storageLocal{}
+	if err := s.InitializeFromURI("file://" + dir); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	defaultNaming := artifactNaming
+	defer func() { artifactNaming = defaultNaming }()
+
+	// The default template also matches the artifacts of `default-admin`
+	if latest, err := s.GetLatestDeployment("default"); err != nil || latest.ID != "-admin3" {
+		t.Errorf("Expected deployment -admin3 with the default template, got %q (%v)", latest.ID, err)
+	}
+
+	if artifactNaming, err = newArtifactNameTemplate("{identifier}{id}.zip", "[0-9]+"); err != nil {
+		t.Fatalf("Unable to parse template: %s", err)
+	}
+
+	latest, err := s.GetLatestDeployment("default")
+	if err != nil || latest.ID != "2" {
+		t.Fatalf("Expected deployment 2, got %q (%v)", latest.ID, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.GetDeploymentArtifact("default", "2", buf); err != nil || buf.String() != "second" {
+		t.Errorf("Unexpected artifact %q (%v)", buf.String(), err)
+	}
+
+	if checksums, err := s.GetDeploymentArtifactChecksums("default", "2"); err != nil || checksums.Size != int64(len("second")) {
+		t.Errorf("Unexpected checksums %+v (%v)", checksums, err)
+	}
+
+	if err := s.GetDeploymentArtifact("default", "3", buf); err != errNoSuchDeployment {
+		t.Errorf("Expected errNoSuchDeployment for missing deployment, got %v", err)
+	}
+
+	if _, err := s.GetLatestDeployment("unknown"); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound for unknown identifier, got %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// storageMulti combines multiple storage providers: The latest deployment
+// is agreed on between all sources, all data of a deployment is fetched
+// from the first healthy source having it and objects are fetched from the
+// first source having them. Sources failing with an error are skipped for
+// the cool-down period. Something is only reported as missing if no source
+// failed or was skipped: A pin only stored on a failing source must not be
+// mistaken for a missing pin.
+type storageMulti struct {
+	sources  []*storageSource
+	cooldown time.Duration
+
+	pins     map[string]storagePin
+	pinsLock sync.Mutex
+}
+
+type storageSource struct {
+	storageProvider
+
+	lock        sync.Mutex
+	failedUntil time.Time
+}
+
+// storagePin records the source used for the deployment of an identifier
+// to fetch version, checksums, metadata and artifact from the same source
+type storagePin struct {
+	DeploymentID string
+	Source       *storageSource
+}
+
+func newStorageMulti(providers []storageProvider, cooldown time.Duration) *storageMulti {
+	s := &storageMulti{cooldown: cooldown, pins: map[string]storagePin{}}
+	for _, p := range providers {
+		s.sources = append(s.sources, &storageSource{storageProvider: p})
+	}
+	return s
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageMulti) InitializeFromURI(uri string) error {
+	// Created from the list of storage URIs, see getConfiguredStorage
+	return errInitializationNotPossible
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment ID for this software. In case a the identifier does not
+// exist an errNoDeploymentFound error must be returned.
+func (s *storageMulti) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	sources := s.activeSources()
+
+	var (
+		latest = make([]deploymentCandidate, len(sources))
+		errs   = make([]error, len(sources))
+		wg     sync.WaitGroup
+	)
+
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src *storageSource) {
+			defer wg.Done()
+			latest[i], errs[i] = src.GetLatestDeployment(identifier)
+			s.track(src, errs[i])
+		}(i, src)
+	}
+	wg.Wait()
+
+	var (
+		reported []deploymentCandidate
+		ids      []string
+		seen     = map[string]bool{}
+		firstErr error
+	)
+
+	for i := range sources {
+		switch {
+		case errs[i] == nil:
+			// The first source reporting a deployment provides its
+			// modification time
+			if !seen[latest[i].ID] {
+				reported = append(reported, latest[i])
+				ids = append(ids, latest[i].ID)
+				seen[latest[i].ID] = true
+			}
+		case errs[i] != errNoDeploymentFound && firstErr == nil:
+			firstErr = errs[i]
+		}
+	}
+
+	switch {
+	case len(reported) > 0:
+		newest, err := selectLatestDeployment(reported)
+		if err == nil && len(reported) > 1 {
+			log.WithFields(log.Fields{
+				"reported": strings.Join(ids, ", "),
+				"selected": newest.ID,
+			}).Debug("Storage sources disagree about latest deployment")
+		}
+		return newest, err
+	case firstErr != nil:
+		return deploymentCandidate{}, firstErr
+	default:
+		return deploymentCandidate{}, errNoDeploymentFound
+	}
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s *storageMulti) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	w := &countingWriter{Writer: dst}
+	return s.deployment(identifier, deploymentID, func(src *storageSource) error {
+		return failoverUnlessWritten(w, src.GetDeploymentArtifact(identifier, deploymentID, w))
+	})
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s *storageMulti) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	var version string
+	err := s.deployment(identifier, deploymentID, func(src *storageSource) (err error) {
+		version, err = src.GetDeploymentArtifactVersion(identifier, deploymentID)
+		return err
+	})
+	return version, err
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s *storageMulti) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	var checksums artifactChecksums
+	err := s.deployment(identifier, deploymentID, func(src *storageSource) (err error) {
+		checksums, err = src.GetDeploymentArtifactChecksums(identifier, deploymentID)
+		return err
+	})
+	return checksums, err
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s *storageMulti) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	var metadata map[string]string
+	err := s.deployment(identifier, deploymentID, func(src *storageSource) (err error) {
+		metadata, err = src.GetDeploymentArtifactMetadata(identifier, deploymentID)
+		return err
+	})
+	return metadata, err
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s *storageMulti) GetObject(name string, dst io.Writer) error {
+	w := &countingWriter{Writer: dst}
+	_, err := s.first(s.sources, errNoSuchObject, func(src *storageSource) error {
+		return failoverUnlessWritten(w, src.GetObject(name, w))
+	})
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s *storageMulti) PutObject(name string, content []byte) error {
+	return s.all(func(src *storageSource) error { return src.PutObject(name, content) })
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s *storageMulti) DeleteObject(name string) error {
+	return s.all(func(src *storageSource) error { return src.DeleteObject(name) })
+}
+
+// String must return a string representation of the provider for debug logging
+func (s *storageMulti) String() string {
+	names := []string{}
+	for _, src := range s.sources {
+		names = append(names, src.String())
+	}
+	return fmt.Sprintf("Multi-source provider with %s", strings.Join(names, ", "))
+}
+
+// deployment calls fn for the source the deployment is pinned to or, if
+// there is none or it is failing, for every source until one of them
+// succeeds and pins that source for the following calls. This
+// prevents combining the checksums of one source with the artifact of
+// another one.
+func (s *storageMulti) deployment(identifier, deploymentID string, fn func(*storageSource) error) error {
+	s.pinsLock.Lock()
+	pin, pinned := s.pins[identifier]
+	s.pinsLock.Unlock()
+
+	sources := s.sources
+	if pinned && pin.DeploymentID == deploymentID && pin.Source.active(time.Now()) {
+		sources = []*storageSource{pin.Source}
+	}
+
+	src, err := s.first(sources, errNoSuchDeployment, fn)
+
+	s.pinsLock.Lock()
+	defer s.pinsLock.Unlock()
+
+	if err != nil {
+		// Select a new source on the next call
+		delete(s.pins, identifier)
+		return err
+	}
+
+	s.pins[identifier] = storagePin{DeploymentID: deploymentID, Source: src}
+	return nil
+}
+
+// failoverUnlessWritten marks errors occurring after data has been
+// written as unrecoverable: Sources failing before writing any data are
+// skipped, failures after data has been written cannot be recovered from.
+func failoverUnlessWritten(w *countingWriter, err error) error {
+	if err != nil && w.N > 0 {
+		return unrecoverableError{err}
+	}
+	return err
+}
+
+// first calls fn for the given sources not in their cool-down period
+// until one of them does not return an error and returns that source. The
+// miss error is only returned if all sources returned it, otherwise the
+// first error (or the skip of a source in its cool-down period) is
+// returned as the missing object might be stored on that source.
+func (s *storageMulti) first(sources []*storageSource, miss error, fn func(*storageSource) error) (*storageSource, error) {
+	var (
+		firstErr error
+		now      = time.Now()
+		tryAll   = true
+	)
+
+	for _, src := range sources {
+		if src.active(now) {
+			// If all sources failed recently all of them are tried anyway
+			tryAll = false
+			break
+		}
+	}
+
+	for _, src := range sources {
+		if !tryAll && !src.active(now) {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("Storage source %s skipped during its cool-down period", src)
+			}
+			continue
+		}
+
+		err := fn(src)
+		if u, ok := err.(unrecoverableError); ok {
+			s.track(src, u.error)
+			return nil, u.error
+		}
+		s.track(src, err)
+
+		switch {
+		case err == nil:
+			return src, nil
+		case err == miss:
+		case firstErr == nil:
+			firstErr = err
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, miss
+}
+
+// all calls fn for every source regardless of its health
+func (s *storageMulti) all(fn func(*storageSource) error) error {
+	var (
+		errs      []string
+		supported bool
+	)
+
+	for _, src := range s.sources {
+		err := fn(src)
+		switch err {
+		case nil:
+			supported = true
+		case errNotSupported:
+		default:
+			supported = true
+			errs = append(errs, fmt.Sprintf("%s: %s", src, err))
+		}
+	}
+
+	if !supported {
+		return errNotSupported
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("Unable to write to %d of %d sources: %s", len(errs), len(s.sources), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// activeSources returns all sources not in their cool-down period in
+// the configured order. If all sources failed recently all of them are
+// returned to try them anyway.
+func (s *storageMulti) activeSources() []*storageSource {
+	var (
+		active []*storageSource
+		now    = time.Now()
+	)
+
+	for _, src := range s.sources {
+		if src.active(now) {
+			active = append(active, src)
+		}
+	}
+
+	if len(active) == 0 {
+		return s.sources
+	}
+	return active
+}
+
+// active reports whether the source is not in its cool-down period
+func (s *storageSource) active(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return !now.Before(s.failedUntil)
+}
+
+// track updates the health of the source after a call to it: Errors
+// other than the ones telling something does not exist mark the source
+// as failed for the cool-down period.
+func (s *storageMulti) track(src *storageSource, err error) {
+	src.lock.Lock()
+	defer src.lock.Unlock()
+
+	switch err {
+	case nil, errNoDeploymentFound, errNoSuchDeployment, errNoSuchObject, errNotSupported:
+		if !src.failedUntil.IsZero() {
+			log.WithField("source", src.String()).Info("Storage source recovered")
+			src.failedUntil = time.Time{}
+		}
+
+	default:
+		if !time.Now().Before(src.failedUntil) {
+			log.WithError(err).WithField("source", src.String()).Warnf("Storage source failed, skipping it for %s", s.cooldown)
+		}
+		src.failedUntil = time.Now().Add(s.cooldown)
+	}
+}
+
+// unrecoverableError wraps errors which must not cause a failover to the
+// next source
+type unrecoverableError struct{ error }
+
+// countingWriter counts the bytes written to the underlying writer
+type countingWriter struct {
+	io.Writer
+	N int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.Writer.Write(p)
+	c.N += int64(n)
+	return n, err
+}
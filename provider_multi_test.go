@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMultiLatestDeploymentUsesOrder(t *testing.T) {
+	now := time.Now()
+
+	primary := &fakeStorage{name: "primary", latest: deploymentCandidate{ID: "b", Modified: now.Add(-time.Hour)}}
+	mirror := &fakeStorage{name: "mirror", latest: deploymentCandidate{ID: "a", Modified: now}}
+
+	latest, err := newStorageMulti([]storageProvider{primary, mirror}, time.Minute).GetLatestDeployment("default")
+	if err != nil {
+		t.Fatalf("Unable to get latest deployment: %s", err)
+	}
+
+	if latest.ID != "a" {
+		t.Errorf("Expected the deployment modified last, got %q", latest.ID)
+	}
+}
+
+func TestMultiPinsDeploymentSource(t *testing.T) {
+	primary := &fakeStorage{name: "primary", artifacts: map[string]string{}}
+	mirror := &fakeStorage{name: "mirror", artifacts: map[string]string{"1": "mirror content"}}
+
+	s := newStorageMulti([]storageProvider{primary, mirror}, time.Minute)
+
+	version, err := s.GetDeploymentArtifactVersion("default", "1")
+	if err != nil || version != "mirror" {
+		t.Fatalf("Expected version of mirror, got %q (%v)", version, err)
+	}
+
+	// The primary receives the deployment while it is fetched: All data
+	// still needs to come from the mirror
+	primary.artifacts["1"] = "primary content with another size"
+
+	checksums, err := s.GetDeploymentArtifactChecksums("default", "1")
+	if err != nil || checksums.Size != int64(len("mirror content")) {
+		t.Errorf("Expected checksums of mirror, got %+v (%v)", checksums, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.GetDeploymentArtifact("default", "1", buf); err != nil || buf.String() != "mirror content" {
+		t.Errorf("Expected artifact of mirror, got %q (%v)", buf.String(), err)
+	}
+
+	metadata, err := s.GetDeploymentArtifactMetadata("default", "1")
+	if err != nil || metadata["source"] != "mirror" {
+		t.Errorf("Expected metadata of mirror, got %v (%v)", metadata, err)
+	}
+
+	// Another deployment selects the source again
+	primary.artifacts["2"] = "primary content"
+	if version, err = s.GetDeploymentArtifactVersion("default", "2"); err != nil || version != "primary" {
+		t.Errorf("Expected version of primary, got %q (%v)", version, err)
+	}
+}
+
+func TestMultiObjectNotMissingWhileSourceFails(t *testing.T) {
+	outage := errors.New("503 Service Unavailable")
+
+	primary := &fakeStorage{name: "primary", err: outage}
+	mirror := &fakeStorage{name: "mirror", objects: map[string]string{}}
+
+	s := newStorageMulti([]storageProvider{primary, mirror}, time.Minute)
+
+	// The pin might be stored on the failing primary only
+	if err := s.GetObject("default.pin", new(bytes.Buffer)); err != outage {
+		t.Errorf("Expected error of the failing source, got %v", err)
+	}
+
+	// While the primary is skipped during its cool-down period the pin
+	// is still not reported as missing
+	calls := primary.calls
+	if err := s.GetObject("default.pin", new(bytes.Buffer)); err == nil || err == errNoSuchObject {
+		t.Errorf("Expected error for the skipped source, got %v", err)
+	}
+	if primary.calls != calls {
+		t.Errorf("Source was queried during its cool-down period")
+	}
+
+	// Objects available on a healthy source are still served
+	mirror.objects["default.pin"] = "1"
+	buf := new(bytes.Buffer)
+	if err := s.GetObject("default.pin", buf); err != nil || buf.String() != "1" {
+		t.Errorf("Expected pin of mirror, got %q (%v)", buf.String(), err)
+	}
+
+	// Only if all sources positively miss the object it is missing
+	primary.err = nil
+	delete(mirror.objects, "default.pin")
+	s = newStorageMulti([]storageProvider{primary, mirror}, time.Minute)
+	if err := s.GetObject("default.pin", new(bytes.Buffer)); err != errNoSuchObject {
+		t.Errorf("Expected errNoSuchObject, got %v", err)
+	}
+}
+
+func TestMultiDeploymentNotMissingWhileSourceFails(t *testing.T) {
+	outage := errors.New("503 Service Unavailable")
+
+	primary := &fakeStorage{name: "primary", err: outage}
+	mirror := &fakeStorage{name: "mirror", artifacts: map[string]string{}}
+
+	s := newStorageMulti([]storageProvider{primary, mirror}, time.Minute)
+
+	if _, err := s.GetDeploymentArtifactVersion("default", "1"); err != outage {
+		t.Errorf("Expected error of the failing source, got %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ociAnnotationCreated = "org.opencontainers.image.created"
+	ociAnnotationTitle   = "org.opencontainers.image.title"
+	ociManifestMaxSize   = 4 * 1024 * 1024
+	ociMediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	ociMediaTypeZIP      = "application/zip"
+)
+
+var (
+	ociChallengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+	// ociArchiveMediaTypes contains the media types of layers which
+	// are considered to contain the deployment archive
+	ociArchiveMediaTypes = []string{
+		ociMediaTypeZIP,
+		"application/gzip",
+		"application/x-tar",
+		"application/zstd",
+		"application/vnd.oci.image.layer.v1.tar",
+		"application/vnd.oci.image.layer.v1.tar+gzip",
+		"application/vnd.oci.image.layer.v1.tar+zstd",
+	}
+)
+
+func init() { registerStorageProvider(&storageOCI{}) }
+
+type storageOCI struct {
+	registry   *url.URL
+	repository string
+	tags       artifactNameTemplate
+
+	password string
+	username string
+
+	client    *http.Client
+	token     string
+	tokenLock sync.Mutex
+
+	// manifests caches the manifests by their digest as tags only need
+	// to be resolved to their digest to detect changes
+	manifests     map[string]*ociManifest
+	manifestsLock sync.Mutex
+	undated       map[string]bool
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ociManifest struct {
+	MediaType   string            `json:"mediaType"`
+	Layers      []ociDescriptor   `json:"layers"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageOCI) InitializeFromURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "oci" {
+		return errInitializationNotPossible
+	}
+
+	s.repository = strings.Trim(u.Path, "/")
+	if s.repository == "" {
+		return fmt.Errorf("No repository given in URI %q", uri)
+	}
+
+	s.registry = &url.URL{Scheme: "https", Host: u.Host}
+	if u.Query().Get("insecure") == "true" {
+		s.registry.Scheme = "http"
+	}
+
+	// Tags can not contain path separators and carry no file extension
+	// so the artifact name template is used without its extension
+	if strings.Contains(artifactNaming.String(), "/") {
+		return fmt.Errorf("Artifact name template %q can not be used for tags", artifactNaming)
+	}
+	if s.tags, err = newArtifactNameTemplate(trimArchiveExtension(artifactNaming.String()), cfg.ArtifactIDPattern); err != nil {
+		return err
+	}
+
+	s.token = os.Getenv("OCI_TOKEN")
+	s.username = os.Getenv("OCI_USERNAME")
+	s.password = os.Getenv("OCI_PASSWORD")
+
+	s.client = &http.Client{Timeout: 10 * time.Minute}
+	s.manifests = map[string]*ociManifest{}
+	s.undated = map[string]bool{}
+	return nil
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s *storageOCI) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	tags, err := s.listTags()
+	if err != nil {
+		return deploymentCandidate{}, err
+	}
+
+	var (
+		deployments = []deploymentCandidate{}
+		seen        = map[string]bool{}
+	)
+
+	for _, tag := range tags {
+		// Pointers, pins and sidecars are rejected by ParseID
+		deploymentID, ok := s.tags.ParseID(identifier, tag)
+		if !ok {
+			continue
+		}
+
+		digest, manifest, err := s.getManifest(tag)
+		if err != nil {
+			return deploymentCandidate{}, fmt.Errorf("Unable to fetch manifest for tag %q: %s", tag, err)
+		}
+		seen[digest] = true
+
+		if _, err := manifest.artifactLayer(); err != nil {
+			log.WithField("tag", tag).WithError(err).Debug("Ignoring tag without archive layer")
+			continue
+		}
+
+		created, err := time.Parse(time.RFC3339, manifest.Annotations[ociAnnotationCreated])
+		if err != nil {
+			// Tags without a (valid) creation annotation are considered
+			// the oldest ones available
+			if !s.undated[tag] {
+				log.WithField("tag", tag).Warnf("Tag has no valid %s annotation, considering it the oldest deployment", ociAnnotationCreated)
+				s.undated[tag] = true
+			}
+		} else {
+			delete(s.undated, tag)
+		}
+
+		deployments = append(deployments, deploymentCandidate{
+			ID:       deploymentID,
+			Modified: created,
+		})
+	}
+
+	s.pruneManifests(seen)
+
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s *storageOCI) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	_, manifest, err := s.getManifest(s.tags.Name(identifier, deploymentID))
+	if err != nil {
+		return err
+	}
+
+	layer, err := manifest.artifactLayer()
+	if err != nil {
+		return err
+	}
+
+	return s.fetchBlob(layer, dst)
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s *storageOCI) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	_, manifest, err := s.getManifest(s.tags.Name(identifier, deploymentID))
+	if err != nil {
+		return "", err
+	}
+
+	layer, err := manifest.artifactLayer()
+	if err != nil {
+		return "", err
+	}
+
+	return layer.Digest, nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s *storageOCI) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	_, manifest, err := s.getManifest(s.tags.Name(identifier, deploymentID))
+	if err != nil {
+		return artifactChecksums{}, err
+	}
+
+	layer, err := manifest.artifactLayer()
+	if err != nil {
+		return artifactChecksums{}, err
+	}
+
+	checksums := artifactChecksums{Size: layer.Size}
+
+	if strings.HasPrefix(layer.Digest, "sha256:") {
+		if checksums.SHA256, err = hex.DecodeString(strings.TrimPrefix(layer.Digest, "sha256:")); err != nil {
+			return checksums, fmt.Errorf("Unable to decode layer digest: %s", err)
+		}
+	}
+
+	return checksums, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s *storageOCI) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	_, manifest, err := s.getManifest(s.tags.Name(identifier, deploymentID))
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest.Annotations, nil
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s *storageOCI) GetObject(name string, dst io.Writer) error {
+	_, manifest, err := s.getManifest(name)
+	if err != nil {
+		if err == errNoSuchDeployment {
+			err = errNoSuchObject
+		}
+		return err
+	}
+
+	if len(manifest.Layers) != 1 {
+		return fmt.Errorf("Expected exactly one layer for %q, found %d", name, len(manifest.Layers))
+	}
+
+	return s.fetchBlob(manifest.Layers[0], dst)
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s *storageOCI) PutObject(name string, content []byte) error {
+	return errNotSupported
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s *storageOCI) DeleteObject(name string) error {
+	return errNotSupported
+}
+
+// String must return a string representation of the provider for debug logging
+func (s *storageOCI) String() string {
+	return fmt.Sprintf("OCI provider at registry %q with repository %q", s.registry.Host, s.repository)
+}
+
+// fetchBlob writes the content of the given layer into the writer and
+// verifies its digest
+func (s *storageOCI) fetchBlob(layer ociDescriptor, dst io.Writer) error {
+	resp, err := s.do(http.MethodGet, "blobs/"+layer.Digest, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, hash), resp.Body); err != nil {
+		return err
+	}
+
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != layer.Digest {
+		return fmt.Errorf("Blob digest mismatch: expected %q, got %q", layer.Digest, digest)
+	}
+
+	return nil
+}
+
+func (s *storageOCI) listTags() ([]string, error) {
+	var (
+		tags  []string
+		query = url.Values{"n": []string{"1000"}}
+	)
+
+	for {
+		resp, err := s.do(http.MethodGet, "tags/list?"+query.Encode(), nil)
+		if err != nil {
+			if err == errNoSuchDeployment {
+				// Repository does not exist (yet)
+				return nil, errNoDeploymentFound
+			}
+			return nil, err
+		}
+
+		page := struct {
+			Tags []string `json:"tags"`
+		}{}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to decode tag list: %s", err)
+		}
+
+		tags = append(tags, page.Tags...)
+
+		if len(page.Tags) == 0 || resp.Header.Get("Link") == "" {
+			return tags, nil
+		}
+		query.Set("last", page.Tags[len(page.Tags)-1])
+	}
+}
+
+// getManifest resolves the reference to the digest of its manifest using
+// a HEAD request and returns the digest and the manifest. Manifests are
+// cached by digest so only changed tags cause the manifest to be fetched.
+func (s *storageOCI) getManifest(reference string) (string, *ociManifest, error) {
+	header := http.Header{"Accept": []string{ociMediaTypeManifest}}
+
+	resp, err := s.do(http.MethodHead, "manifests/"+reference, header)
+	if err != nil {
+		return "", nil, err
+	}
+	resp.Body.Close()
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !strings.HasPrefix(digest, "sha256:") {
+		// Registry does not report (verifiable) digests, fetch the
+		// manifest by the reference without caching
+		manifest, _, err := s.fetchManifest(reference, header)
+		return "", manifest, err
+	}
+
+	s.manifestsLock.Lock()
+	manifest, ok := s.manifests[digest]
+	s.manifestsLock.Unlock()
+	if ok {
+		return digest, manifest, nil
+	}
+
+	manifest, raw, err := s.fetchManifest(digest, header)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if sum := sha256.Sum256(raw); "sha256:"+hex.EncodeToString(sum[:]) != digest {
+		return "", nil, fmt.Errorf("Manifest digest mismatch for %q", reference)
+	}
+
+	s.manifestsLock.Lock()
+	s.manifests[digest] = manifest
+	s.manifestsLock.Unlock()
+
+	return digest, manifest, nil
+}
+
+func (s *storageOCI) fetchManifest(reference string, header http.Header) (*ociManifest, []byte, error) {
+	resp, err := s.do(http.MethodGet, "manifests/"+reference, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	raw, err := ioutil.ReadAll(io.LimitReader(resp.Body, ociManifestMaxSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read manifest: %s", err)
+	}
+
+	manifest := &ociManifest{}
+	if err := json.Unmarshal(raw, manifest); err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode manifest: %s", err)
+	}
+
+	return manifest, raw, nil
+}
+
+// pruneManifests removes all cached manifests not referenced by the last
+// listing to keep the cache from growing
+func (s *storageOCI) pruneManifests(keep map[string]bool) {
+	s.manifestsLock.Lock()
+	defer s.manifestsLock.Unlock()
+
+	for digest := range s.manifests {
+		if !keep[digest] {
+			delete(s.manifests, digest)
+		}
+	}
+}
+
+// do executes a request against the repository inside the registry and
+// handles the bearer token authentication. A missing resource is
+// reported as errNoSuchDeployment.
+func (s *storageOCI) do(method, path string, header http.Header) (*http.Response, error) {
+	u := s.registry.String() + "/v2/" + s.repository + "/" + path
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		s.tokenLock.Lock()
+		if s.token != "" {
+			req.Header.Set("Authorization", "Bearer "+s.token)
+		}
+		s.tokenLock.Unlock()
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode < 300:
+			return resp, nil
+
+		case resp.StatusCode == http.StatusUnauthorized && attempt == 0:
+			challenge := resp.Header.Get("WWW-Authenticate")
+			resp.Body.Close()
+			if err := s.fetchToken(challenge); err != nil {
+				return nil, fmt.Errorf("Unable to authenticate against registry: %s", err)
+			}
+			continue
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, errNoSuchDeployment
+		}
+
+		return nil, fmt.Errorf("Registry request failed with status %d", resp.StatusCode)
+	}
+}
+
+// fetchToken requests a new bearer token from the realm given in the
+// challenge returned by the registry
+func (s *storageOCI) fetchToken(challenge string) error {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return fmt.Errorf("Unsupported authentication challenge %q", challenge)
+	}
+
+	params := map[string]string{}
+	for _, m := range ociChallengeParam.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+
+	if params["realm"] == "" {
+		return fmt.Errorf("No realm in authentication challenge %q", challenge)
+	}
+
+	query := url.Values{}
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			query.Set(k, params[k])
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Token endpoint returned status %d", resp.StatusCode)
+	}
+
+	token := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("Unable to decode token response: %s", err)
+	}
+
+	s.tokenLock.Lock()
+	defer s.tokenLock.Unlock()
+
+	s.token = token.Token
+	if s.token == "" {
+		s.token = token.AccessToken
+	}
+
+	return nil
+}
+
+// artifactLayer selects the layer containing the archive: Either the
+// one marked as archive or the only layer present
+func (m ociManifest) artifactLayer() (ociDescriptor, error) {
+	for _, l := range m.Layers {
+		if title := l.Annotations[ociAnnotationTitle]; title != "" && trimArchiveExtension(title) != title {
+			return l, nil
+		}
+
+		for _, mt := range ociArchiveMediaTypes {
+			if l.MediaType == mt {
+				return l, nil
+			}
+		}
+	}
+
+	if len(m.Layers) == 1 {
+		return m.Layers[0], nil
+	}
+
+	return ociDescriptor{}, fmt.Errorf("No archive layer found in manifest (%d layers)", len(m.Layers))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeRegistry struct {
+	manifests map[string][]byte // by tag
+	blobs     map[string][]byte // by digest
+
+	lock         sync.Mutex
+	manifestGets int
+}
+
+func (f *fakeRegistry) addTag(tag string, manifest string) {
+	f.manifests[tag] = []byte(manifest)
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/v2/my/app/"
+	p := strings.TrimPrefix(r.URL.Path, prefix)
+
+	switch {
+	case p == "tags/list":
+		tags := []string{}
+		for t := range f.manifests {
+			tags = append(tags, `"`+t+`"`)
+		}
+		fmt.Fprintf(w, `{"tags":[%s]}`, strings.Join(tags, ","))
+
+	case strings.HasPrefix(p, "manifests/"):
+		ref := strings.TrimPrefix(p, "manifests/")
+		var body []byte
+		for _, m := range f.manifests {
+			if ref == digestOf(m) {
+				body = m
+			}
+		}
+		if m, ok := f.manifests[ref]; ok {
+			body = m
+		}
+		if body == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Docker-Content-Digest", digestOf(body))
+		if r.Method == http.MethodGet {
+			f.lock.Lock()
+			f.manifestGets++
+			f.lock.Unlock()
+			w.Write(body)
+		}
+
+	case strings.HasPrefix(p, "blobs/"):
+		b, ok := f.blobs[strings.TrimPrefix(p, "blobs/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(b)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func digestOf(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func archiveManifest(digest, created string) string {
+	annotations := ""
+	if created != "" {
+		annotations = fmt.Sprintf(`,"annotations":{"%s":"%s"}`, ociAnnotationCreated, created)
+	}
+	return fmt.Sprintf(`{"layers":[{"mediaType":"application/zip","digest":"%s","size":2}]%s}`, digest, annotations)
+}
+
+func TestOCILatestDeploymentIgnoresAuxiliaryTags(t *testing.T) {
+	reg := &fakeRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	blob := digestOf([]byte("PK"))
+
+	reg.addTag("default1", archiveManifest(blob, "2020-01-01T00:00:00Z"))
+	reg.addTag("default2", archiveManifest(blob, "2020-01-02T00:00:00Z"))
+	reg.addTag("default3", archiveManifest(blob, ""))
+	// Auxiliary objects created after the deployments
+	for _, tag := range []string{"default.latest", "default.pin", "default2.sig", "default2.sha256", "default2.json"} {
+		reg.addTag(tag, archiveManifest(blob, "2021-01-01T00:00:00Z"))
+	}
+
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+
+	s := &storageOCI{}
+	if err := s.InitializeFromURI("oci://" + strings.TrimPrefix(srv.URL, "http://") + "/my/app?insecure=true"); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+
+	for poll := 0; poll < 2; poll++ {
+		latest, err := s.GetLatestDeployment("default")
+		if err != nil {
+			t.Fatalf("Unable to get latest deployment: %s", err)
+		}
+		if latest.ID != "2" {
+			t.Errorf("Expected deployment 2, got %q", latest.ID)
+		}
+	}
+
+	// Only the manifests of the three deployments are fetched and only
+	// once as they did not change between the polls
+	if reg.manifestGets != 3 {
+		t.Errorf("Expected 3 manifest fetches, got %d", reg.manifestGets)
+	}
+
+	if !s.undated["default3"] {
+		t.Errorf("Tag without creation annotation was not reported")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3TimeFormat    = "20060102T150405Z"
+)
+
+func init() { registerStorageProvider(&storageS3{}) }
+
+type storageS3 struct {
+	bucketName string
+	endpoint   *url.URL
+	pathStyle  bool
+	prefix     string
+	region     string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageS3) InitializeFromURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "s3" {
+		return errInitializationNotPossible
+	}
+
+	s.bucketName = u.Host
+	s.prefix = strings.TrimPrefix(u.Path, "/")
+	if len(s.prefix) > 0 && !strings.HasSuffix(s.prefix, "/") {
+		s.prefix = s.prefix + "/"
+	}
+
+	s.region = u.Query().Get("region")
+	for _, envVar := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if s.region == "" {
+			s.region = os.Getenv(envVar)
+		}
+	}
+	if s.region == "" {
+		s.region = s3DefaultRegion
+	}
+
+	endpoint := u.Query().Get("endpoint")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return fmt.Errorf("Unable to parse S3 endpoint %q: %s", endpoint, err)
+	}
+
+	s.pathStyle = u.Query().Get("path-style") == "true"
+
+	s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	s.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+
+	s.client = &http.Client{Timeout: 10 * time.Minute}
+	return nil
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s storageS3) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	var (
+		deployments []deploymentCandidate
+		token       string
+	)
+
+	for {
+		params := url.Values{
+			"list-type": []string{"2"},
+			"delimiter": []string{"/"},
+			"prefix":    []string{s.prefix + artifactNaming.Prefix(identifier)},
+		}
+		if token != "" {
+			params.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", params, nil)
+		if err != nil {
+			return deploymentCandidate{}, err
+		}
+
+		result := s3ListBucketResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return deploymentCandidate{}, fmt.Errorf("Unable to decode object listing: %s", err)
+		}
+
+		for _, obj := range result.Contents {
+			deploymentID, ok := artifactNaming.ParseID(identifier, strings.TrimPrefix(obj.Key, s.prefix))
+			if !ok {
+				continue
+			}
+
+			deployments = append(deployments, deploymentCandidate{ID: deploymentID, Modified: obj.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s storageS3) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	err := s.GetObject(artifactNaming.Name(identifier, deploymentID), dst)
+	if err == errNoSuchObject {
+		err = errNoSuchDeployment
+	}
+	return err
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s storageS3) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+artifactNaming.Name(identifier, deploymentID), nil, nil)
+	if err != nil {
+		if err == errNoSuchObject {
+			err = errNoSuchDeployment
+		}
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("ETag"), nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s storageS3) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+artifactNaming.Name(identifier, deploymentID), nil, nil)
+	if err != nil {
+		if err == errNoSuchObject {
+			err = errNoSuchDeployment
+		}
+		return artifactChecksums{}, err
+	}
+	resp.Body.Close()
+
+	// The ETag is not used as MD5 as it differs for multipart uploads
+	// and encrypted objects
+	return artifactChecksums{Size: resp.ContentLength}, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s storageS3) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	resp, err := s.do(http.MethodHead, s.prefix+artifactNaming.Name(identifier, deploymentID), nil, nil)
+	if err != nil {
+		if err == errNoSuchObject {
+			err = errNoSuchDeployment
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+
+	return headerMetadata(resp.Header, "X-Amz-Meta-"), nil
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s storageS3) GetObject(name string, dst io.Writer) error {
+	resp, err := s.do(http.MethodGet, s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(dst, resp.Body)
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s storageS3) PutObject(name string, content []byte) error {
+	resp, err := s.do(http.MethodPut, s.prefix+name, nil, content)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s storageS3) DeleteObject(name string) error {
+	resp, err := s.do(http.MethodDelete, s.prefix+name, nil, nil)
+	if err != nil && err != errNoSuchObject {
+		return err
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// String must return a string representation of the provider for debug logging
+func (s storageS3) String() string {
+	return fmt.Sprintf("S3 provider at bucket %q with prefix %q (endpoint %q)", s.bucketName, s.prefix, s.endpoint.Host)
+}
+
+// do executes a signed request against the bucket and returns the
+// response if the status code indicates success. A missing object is
+// reported as errNoSuchObject.
+func (s storageS3) do(method, key string, params url.Values, body []byte) (*http.Response, error) {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucketName + "/" + key
+	} else {
+		u.Host = s.bucketName + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawQuery = s3CanonicalQuery(params)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	// Ensure the path sent on the wire matches the one being signed
+	req.URL.RawPath = s3EncodeURI(req.URL.Path, false)
+
+	s.signRequest(req, s3SHA256Hex(body), time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && key != "" {
+		return nil, errNoSuchObject
+	}
+
+	errBody, _ := ioutil.ReadAll(resp.Body)
+	s3Err := s3Error{}
+	if err := xml.Unmarshal(errBody, &s3Err); err != nil || s3Err.Code == "" {
+		return nil, fmt.Errorf("S3 request failed with status %d", resp.StatusCode)
+	}
+
+	return nil, fmt.Errorf("S3 request failed with status %d: %s (%s)", resp.StatusCode, s3Err.Message, s3Err.Code)
+}
+
+// signRequest adds an AWS Signature Version 4 to the request. If no
+// credentials are configured the request is left unsigned for use
+// with public buckets.
+func (s storageS3) signRequest(req *http.Request, payloadHash string, now time.Time) {
+	if s.accessKey == "" || s.secretKey == "" {
+		return
+	}
+
+	amzDate := now.Format(s3TimeFormat)
+	scope := strings.Join([]string{now.Format("20060102"), s.region, "s3", "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	canonicalRequest, signedHeaders := s3CanonicalRequest(req, payloadHash)
+	stringToSign := s3StringToSign(canonicalRequest, amzDate, scope)
+
+	signingKey := []byte("AWS4" + s.secretKey)
+	for _, part := range strings.Split(scope, "/") {
+		signingKey = s3HMAC(signingKey, []byte(part))
+	}
+	signature := hex.EncodeToString(s3HMAC(signingKey, []byte(stringToSign)))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature,
+	))
+}
+
+// s3CanonicalRequest builds the canonical form of the request signing all
+// of its headers and returns it together with the signed header names
+func s3CanonicalRequest(req *http.Request, payloadHash string) (string, string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(req.Header.Get(k))
+	}
+
+	headerNames := []string{}
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+
+	canonicalHeaders := new(bytes.Buffer)
+	for _, k := range headerNames {
+		fmt.Fprintf(canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n"), signedHeaders
+}
+
+func s3StringToSign(canonicalRequest, amzDate, scope string) string {
+	return strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		s3SHA256Hex([]byte(canonicalRequest)),
+	}, "\n")
+}
+
+func s3CanonicalQuery(params url.Values) string {
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		for _, v := range params[k] {
+			parts = append(parts, s3EncodeURI(k, true)+"="+s3EncodeURI(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// s3EncodeURI encodes the given string according to the rules of the
+// AWS signature: Only unreserved characters of RFC 3986 are kept.
+func s3EncodeURI(in string, encodeSlash bool) string {
+	out := new(bytes.Buffer)
+	for _, c := range []byte(in) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			out.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+func s3HMAC(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func s3SHA256Hex(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
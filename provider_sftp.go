@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// All requests of a run (latest pointer, pin, listing, artifact) share
+// the SSH session which is closed after being idle for this duration
+const sftpSessionIdleTimeout = 30 * time.Second
+
+func init() { registerStorageProvider(&storageSFTP{}) }
+
+type storageSFTP struct {
+	host string
+	path string
+	port string
+	user string
+
+	identity       string
+	knownHosts     string
+	ignoreHostKeys bool
+
+	session     *sftpSession
+	sessionIdle *time.Timer
+	sessionLock sync.Mutex
+}
+
+// sftpSession is a SFTP client on top of a running ssh process
+type sftpSession struct {
+	*sftp.Client
+	cmd *exec.Cmd
+}
+
+func (s *sftpSession) Close() error {
+	s.Client.Close()
+	return s.cmd.Wait()
+}
+
+// InitializeFromURI retrieves the user input URI and must decide whether
+// it can initialize from that or can't. If the URI is not suitable for the
+// provider an errInitializationNotPossible error needs to be returned. If
+// the initialization failed because of an error it must be returned.
+func (s *storageSFTP) InitializeFromURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "sftp" {
+		return errInitializationNotPossible
+	}
+
+	s.host = u.Hostname()
+	s.port = u.Port()
+	if u.User != nil {
+		s.user = u.User.Username()
+	}
+
+	s.path = u.Path
+	if s.path == "" {
+		s.path = "."
+	}
+
+	s.identity = u.Query().Get("identity")
+	s.knownHosts = u.Query().Get("known-hosts")
+	s.ignoreHostKeys = u.Query().Get("insecure-ignore-host-key") == "true"
+
+	return nil
+}
+
+// GetLatestDeployment retrieves a software identifier and must return the
+// latest deployment for this software (its ID and, if known, the time it
+// was last modified). In case a the identifier does not exist an
+// errNoDeploymentFound error must be returned.
+func (s *storageSFTP) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	dir := artifactNaming.Dir(identifier)
+
+	var files []os.FileInfo
+	err := s.withClient(func(client *sftp.Client) (err error) {
+		files, err = client.ReadDir(path.Join(s.path, dir))
+		return err
+	})
+	if err != nil {
+		if os.IsNotExist(err) {
+			return deploymentCandidate{}, errNoDeploymentFound
+		}
+		return deploymentCandidate{}, err
+	}
+
+	deployments := []deploymentCandidate{}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		deploymentID, ok := artifactNaming.ParseID(identifier, path.Join(dir, f.Name()))
+		if !ok {
+			continue
+		}
+
+		deployments = append(deployments, deploymentCandidate{ID: deploymentID, Modified: f.ModTime()})
+	}
+
+	return selectLatestDeployment(deployments)
+}
+
+// GetDeploymentArtifact retrieves an software identifier, a deployment ID
+// and a writer and must write the archive of the artifact into the writer.
+// In case there is no artifact for the given identifier and deploymentID an
+// errNoSuchDeployment error must be returned.
+func (s *storageSFTP) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	err := s.GetObject(artifactNaming.Name(identifier, deploymentID), dst)
+	if err == errNoSuchObject {
+		err = errNoSuchDeployment
+	}
+	return err
+}
+
+// GetDeploymentArtifactVersion retrieves an software identifier and a
+// deployment ID and must return a string identifying the current revision
+// of the artifact (generation, ETag, checksum, ...) which changes whenever
+// the artifact is replaced. If the provider is not able to determine the
+// revision an empty string must be returned. In case there is no artifact
+// for the given identifier and deploymentID an errNoSuchDeployment error
+// must be returned.
+func (s *storageSFTP) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	stat, err := s.statArtifact(identifier, deploymentID)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%d", stat.Size(), stat.ModTime().Unix()), nil
+}
+
+// GetDeploymentArtifactChecksums retrieves an software identifier and a
+// deployment ID and must return the checksums of the artifact known to
+// the storage (size, MD5, CRC32C, SHA256). Checksums the provider does
+// not know must be left empty. In case there is no artifact for the
+// given identifier and deploymentID an errNoSuchDeployment error must
+// be returned.
+func (s *storageSFTP) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	stat, err := s.statArtifact(identifier, deploymentID)
+	if err != nil {
+		return artifactChecksums{}, err
+	}
+
+	return artifactChecksums{Size: stat.Size()}, nil
+}
+
+// GetDeploymentArtifactMetadata retrieves an software identifier and a
+// deployment ID and must return the metadata attached to the artifact
+// (like commit SHA, author or changelog). Providers not able to store
+// metadata with the artifact read it from a JSON sidecar object (see
+// fetchMetadataSidecar). If there is no metadata nil must be returned.
+func (s *storageSFTP) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	return fetchMetadataSidecar(s, identifier, deploymentID)
+}
+
+// GetObject retrieves the name of an auxiliary object (like the latest
+// pointer) stored next to the artifacts and must write its content into
+// the writer. In case the object does not exist an errNoSuchObject error
+// must be returned.
+func (s *storageSFTP) GetObject(name string, dst io.Writer) error {
+	err := s.withClient(func(client *sftp.Client) error {
+		f, err := client.Open(path.Join(s.path, name))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(dst, f)
+		return err
+	})
+	if os.IsNotExist(err) {
+		err = errNoSuchObject
+	}
+	return err
+}
+
+// PutObject retrieves the name of an auxiliary object and its content
+// and must store the object next to the artifacts. If the provider does
+// not support writing objects an errNotSupported error must be returned.
+func (s *storageSFTP) PutObject(name string, content []byte) error {
+	return s.withClient(func(client *sftp.Client) error {
+		f, err := client.OpenFile(path.Join(s.path, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.Write(content); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	})
+}
+
+// DeleteObject retrieves the name of an auxiliary object and must remove
+// the object. Removing a non-existent object must not cause an error. If
+// the provider does not support writing objects an errNotSupported error
+// must be returned.
+func (s *storageSFTP) DeleteObject(name string) error {
+	err := s.withClient(func(client *sftp.Client) error {
+		return client.Remove(path.Join(s.path, name))
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// String must return a string representation of the provider for debug logging
+func (s *storageSFTP) String() string {
+	return fmt.Sprintf("SFTP provider at host %q with path %q", s.host, s.path)
+}
+
+// statArtifact returns the file information of the artifact
+func (s *storageSFTP) statArtifact(identifier, deploymentID string) (os.FileInfo, error) {
+	var stat os.FileInfo
+	err := s.withClient(func(client *sftp.Client) (err error) {
+		stat, err = client.Stat(path.Join(s.path, artifactNaming.Name(identifier, deploymentID)))
+		return err
+	})
+	if os.IsNotExist(err) {
+		err = errNoSuchDeployment
+	}
+	return stat, err
+}
+
+// withClient calls fn with the client of the current session and starts a
+// new session if there is none. Sessions are closed after errors (other
+// than missing files) as the connection might be broken and after being
+// idle for sftpSessionIdleTimeout.
+func (s *storageSFTP) withClient(fn func(*sftp.Client) error) error {
+	s.sessionLock.Lock()
+	defer s.sessionLock.Unlock()
+
+	if s.session == nil {
+		session, err := s.connect()
+		if err != nil {
+			return err
+		}
+		s.session = session
+	}
+
+	err := fn(s.session.Client)
+	if err != nil && !os.IsNotExist(err) {
+		s.closeSession()
+		return err
+	}
+
+	if s.sessionIdle == nil {
+		s.sessionIdle = time.AfterFunc(sftpSessionIdleTimeout, func() {
+			s.sessionLock.Lock()
+			defer s.sessionLock.Unlock()
+			s.closeSession()
+		})
+	} else {
+		s.sessionIdle.Reset(sftpSessionIdleTimeout)
+	}
+
+	return err
+}
+
+// closeSession terminates the current session, the session lock must be
+// held by the caller
+func (s *storageSFTP) closeSession() {
+	if s.session == nil {
+		return
+	}
+
+	s.session.Close()
+	s.session = nil
+}
+
+// connect starts the sftp subsystem through the system ssh client and
+// returns a session with a client on top of it
+func (s *storageSFTP) connect() (*sftpSession, error) {
+	args := []string{"-o", "BatchMode=yes"}
+
+	if s.ignoreHostKeys {
+		args = append(args, "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null")
+	} else {
+		args = append(args, "-o", "StrictHostKeyChecking=yes")
+		if s.knownHosts != "" {
+			args = append(args, "-o", "UserKnownHostsFile="+s.knownHosts)
+		}
+	}
+
+	if s.identity != "" {
+		args = append(args, "-o", "IdentitiesOnly=yes", "-i", s.identity)
+	}
+
+	if s.port != "" {
+		args = append(args, "-p", s.port)
+	}
+
+	if s.user != "" {
+		args = append(args, "-l", s.user)
+	}
+
+	// Terminate the options to prevent a host starting with a dash from
+	// being interpreted as an option
+	args = append(args, "-s", "--", s.host, "sftp")
+
+	stderr := new(bytes.Buffer)
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("Unable to start ssh: %s", err)
+	}
+
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		stdin.Close()
+		cmd.Wait()
+		return nil, fmt.Errorf("Unable to initialize SFTP session: %s (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return &sftpSession{Client: client, cmd: cmd}, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpTestServerEnv makes the test binary serve SFTP on stdin / stdout
+// instead of running the tests when started by the fake ssh client
+const sftpTestServerEnv = "DEPLOY_TEST_SFTP_SERVER"
+
+type sftpTestPipe struct {
+	io.Reader
+	io.WriteCloser
+}
+
+func TestSFTPServerProcess(t *testing.T) {
+	if os.Getenv(sftpTestServerEnv) == "" {
+		return
+	}
+
+	server, err := sftp.NewServer(sftpTestPipe{os.Stdin, os.Stdout})
+	if err != nil {
+		os.Exit(1)
+	}
+	if err := server.Serve(); err != nil && err != io.EOF {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// installTestSSH puts a fake ssh client into the PATH which records its
+// arguments and starts the test binary as SFTP server
+func installTestSSH(t *testing.T, dir string) string {
+	calls := path.Join(dir, "ssh-calls")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" >>%q\n%s=1 exec %q -test.run=TestSFTPServerProcess\n", calls, sftpTestServerEnv, os.Args[0])
+
+	if err := ioutil.WriteFile(path.Join(dir, "ssh"), []byte(script), 0755); err != nil {
+		t.Fatalf("Unable to write fake ssh: %s", err)
+	}
+	return calls
+}
+
+func TestSFTPStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deploy-sftp-test-")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	calls := installTestSSH(t, dir)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	storageDir := path.Join(dir, "storage")
+	if err := os.Mkdir(storageDir, 0700); err != nil {
+		t.Fatalf("Unable to create storage: %s", err)
+	}
+
+	now := time.Now()
+	writeTestArtifact(t, storageDir, "default1.zip", "first", now.Add(-2*time.Hour))
+	writeTestArtifact(t, storageDir, "default2.zip", "second", now.Add(-time.Hour))
+	writeTestArtifact(t, storageDir, "default2.zip.sig", "", now)
+
+	s := &storageSFTP{}
+	if err := s.InitializeFromURI("sftp://deploy@-oProxyCommand=test:2222" + storageDir + "?identity=/tmp/id&insecure-ignore-host-key=true"); err != nil {
+		t.Fatalf("Initialization failed: %s", err)
+	}
+	defer func() {
+		s.sessionLock.Lock()
+		defer s.sessionLock.Unlock()
+		s.closeSession()
+	}()
+
+	latest, err := s.GetLatestDeployment("default")
+	if err != nil || latest.ID != "2" {
+		t.Fatalf("Expected deployment 2, got %q (%v)", latest.ID, err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := s.GetDeploymentArtifact("default", "2", buf); err != nil || buf.String() != "second" {
+		t.Errorf("Unexpected artifact %q (%v)", buf.String(), err)
+	}
+
+	if version, err := s.GetDeploymentArtifactVersion("default", "2"); err != nil || version != fmt.Sprintf("6-%d", now.Add(-time.Hour).Unix()) {
+		t.Errorf("Unexpected version %q (%v)", version, err)
+	}
+
+	if checksums, err := s.GetDeploymentArtifactChecksums("default", "2"); err != nil || checksums.Size != 6 {
+		t.Errorf("Unexpected checksums %+v (%v)", checksums, err)
+	}
+
+	if err := s.GetDeploymentArtifact("default", "3", buf); err != errNoSuchDeployment {
+		t.Errorf("Expected errNoSuchDeployment for missing artifact, got %v", err)
+	}
+
+	if _, err := s.GetDeploymentArtifactVersion("default", "3"); err != errNoSuchDeployment {
+		t.Errorf("Expected errNoSuchDeployment for missing artifact, got %v", err)
+	}
+
+	if err := s.PutObject("default.latest", []byte("1")); err != nil {
+		t.Fatalf("Unable to write pointer: %s", err)
+	}
+
+	buf.Reset()
+	if err := s.GetObject("default.latest", buf); err != nil || buf.String() != "1" {
+		t.Errorf("Unexpected pointer %q (%v)", buf.String(), err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.DeleteObject("default.latest"); err != nil {
+			t.Errorf("Unable to delete pointer: %s", err)
+		}
+	}
+
+	if err := s.GetObject("default.latest", buf); err != errNoSuchObject {
+		t.Errorf("Expected errNoSuchObject for deleted pointer, got %v", err)
+	}
+
+	if _, err := s.GetLatestDeployment("unknown"); err != errNoDeploymentFound {
+		t.Errorf("Expected errNoDeploymentFound for unknown identifier, got %v", err)
+	}
+
+	// All requests share one session, the host is never parsed as option
+	rawCalls, err := ioutil.ReadFile(calls)
+	if err != nil {
+		t.Fatalf("Unable to read ssh calls: %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(rawCalls)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("Expected one ssh session, got %d", len(lines))
+	}
+	if !strings.HasSuffix(lines[0], "-p 2222 -l deploy -s -- -oProxyCommand=test sftp") || !strings.Contains(lines[0], "-i /tmp/id") {
+		t.Errorf("Unexpected ssh arguments %q", lines[0])
+	}
+}
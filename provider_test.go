@@ -0,0 +1,115 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// fakeStorage serves deployments and objects from memory. If err is set
+// every call fails with it.
+type fakeStorage struct {
+	name      string
+	latest    deploymentCandidate
+	artifacts map[string]string
+	objects   map[string]string
+	err       error
+
+	lock  sync.Mutex
+	calls int
+}
+
+func (f *fakeStorage) call() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	f.calls++
+	return f.err
+}
+
+func (f *fakeStorage) InitializeFromURI(uri string) error { return errInitializationNotPossible }
+
+func (f *fakeStorage) GetLatestDeployment(identifier string) (deploymentCandidate, error) {
+	if err := f.call(); err != nil {
+		return deploymentCandidate{}, err
+	}
+	if f.latest.ID == "" {
+		return deploymentCandidate{}, errNoDeploymentFound
+	}
+	return f.latest, nil
+}
+
+func (f *fakeStorage) GetDeploymentArtifact(identifier, deploymentID string, dst io.Writer) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+	content, ok := f.artifacts[deploymentID]
+	if !ok {
+		return errNoSuchDeployment
+	}
+	_, err := io.WriteString(dst, content)
+	return err
+}
+
+func (f *fakeStorage) GetDeploymentArtifactVersion(identifier, deploymentID string) (string, error) {
+	if err := f.call(); err != nil {
+		return "", err
+	}
+	if _, ok := f.artifacts[deploymentID]; !ok {
+		return "", errNoSuchDeployment
+	}
+	return f.name, nil
+}
+
+func (f *fakeStorage) GetDeploymentArtifactChecksums(identifier, deploymentID string) (artifactChecksums, error) {
+	if err := f.call(); err != nil {
+		return artifactChecksums{}, err
+	}
+	content, ok := f.artifacts[deploymentID]
+	if !ok {
+		return artifactChecksums{}, errNoSuchDeployment
+	}
+	return artifactChecksums{Size: int64(len(content))}, nil
+}
+
+func (f *fakeStorage) GetDeploymentArtifactMetadata(identifier, deploymentID string) (map[string]string, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	if _, ok := f.artifacts[deploymentID]; !ok {
+		return nil, errNoSuchDeployment
+	}
+	return map[string]string{"source": f.name}, nil
+}
+
+func (f *fakeStorage) GetObject(name string, dst io.Writer) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+	content, ok := f.objects[name]
+	if !ok {
+		return errNoSuchObject
+	}
+	_, err := io.WriteString(dst, content)
+	return err
+}
+
+func (f *fakeStorage) PutObject(name string, content []byte) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+	if f.objects == nil {
+		f.objects = map[string]string{}
+	}
+	f.objects[name] = string(content)
+	return nil
+}
+
+func (f *fakeStorage) DeleteObject(name string) error {
+	if err := f.call(); err != nil {
+		return err
+	}
+	delete(f.objects, name)
+	return nil
+}
+
+func (f *fakeStorage) String() string { return f.name }
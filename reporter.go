@@ -12,7 +12,7 @@ var (
 
 type reporterList []reporter
 
-func (r reporterList) Execute(success bool, content, deploymentID string) []error {
+func (r reporterList) Execute(success bool, content, deploymentID, pin string, metadata map[string]string) []error {
 	hostname, err := os.Hostname()
 	if err != nil {
 		return []error{err}
@@ -21,7 +21,7 @@ func (r reporterList) Execute(success bool, content, deploymentID string) []erro
 	var errors []error
 
 	for _, i := range r {
-		if err := i.Execute(success, content, deploymentID, hostname); err != nil {
+		if err := i.Execute(success, content, deploymentID, hostname, pin, metadata); err != nil {
 			errors = append(errors, err)
 		}
 	}
@@ -35,9 +35,10 @@ type reporter interface {
 	// provider an errInitializationNotPossible error needs to be returned. If
 	// the initialization failed because of an error it must be returned.
 	InitializeFromURI(uri string) error
-	// Execute takes the content of the reporting and executes the
-	// delivery of the message to the specified targets.
-	Execute(success bool, content, deploymentID, hostname string) error
+	// Execute takes the content of the reporting, the pin (empty if the
+	// deployment is not pinned) and the metadata of the deployment artifact
+	// and executes the delivery of the message to the specified targets.
+	Execute(success bool, content, deploymentID, hostname, pin string, metadata map[string]string) error
 }
 
 func registerReporter(r reporter) {
@@ -33,9 +33,10 @@ func (r *reporterFile) InitializeFromURI(uri string) error {
 	return nil
 }
 
-// Execute takes the content of the reporting and executes the
-// delivery of the message to the specified targets.
-func (r reporterFile) Execute(success bool, content, deploymentID, hostname string) error {
+// Execute takes the content of the reporting, the pin (empty if the
+// deployment is not pinned) and the metadata of the deployment artifact
+// and executes the delivery of the message to the specified targets.
+func (r reporterFile) Execute(success bool, content, deploymentID, hostname, pin string, metadata map[string]string) error {
 	fileName := r.path
 	for k, v := range map[string]string{
 		`{s}`: cfg.SoftwareIdentifier,
@@ -63,6 +64,12 @@ func (r reporterFile) Execute(success bool, content, deploymentID, hostname stri
 	}
 
 	fmt.Fprintf(fp, "[%s] Deployment %q finished %s:\n", time.Now().Format(time.RFC3339), deploymentID, verb)
+	if pin != "" {
+		fmt.Fprintf(fp, "Pinned to %s\n", pin)
+	}
+	for _, k := range sortedMetadataKeys(metadata) {
+		fmt.Fprintf(fp, "Metadata %s: %s\n", k, strings.Replace(metadata[k], "\n", "\n  ", -1))
+	}
 	fmt.Fprintln(fp, content)
 
 	return nil
@@ -33,9 +33,10 @@ func (r *reporterSlack) InitializeFromURI(uri string) error {
 	return nil
 }
 
-// Execute takes the content of the reporting and executes the
-// delivery of the message to the specified targets.
-func (r reporterSlack) Execute(success bool, content, deploymentID, hostname string) error {
+// Execute takes the content of the reporting, the pin (empty if the
+// deployment is not pinned) and the metadata of the deployment artifact
+// and executes the delivery of the message to the specified targets.
+func (r reporterSlack) Execute(success bool, content, deploymentID, hostname, pin string, metadata map[string]string) error {
 	// {
 	//   "attachments": [
 	//     {
@@ -71,29 +72,48 @@ func (r reporterSlack) Execute(success bool, content, deploymentID, hostname str
 		msgColor = "#3c763d"
 	}
 
+	fields := []*chat.Field{
+		{
+			Title: "Host",
+			Value: hostname,
+			Short: true,
+		},
+		{
+			Title: "Deployment-ID",
+			Value: deploymentID,
+			Short: true,
+		},
+		{
+			Title: "Software Identifier",
+			Value: cfg.SoftwareIdentifier,
+			Short: true,
+		},
+	}
+
+	if pin != "" {
+		fields = append(fields, &chat.Field{
+			Title: "Pinned",
+			Value: pin,
+			Short: true,
+		})
+	}
+
+	for _, k := range sortedMetadataKeys(metadata) {
+		fields = append(fields, &chat.Field{
+			Title: k,
+			Value: metadata[k],
+			// Long values like changelogs get the full width
+			Short: len(metadata[k]) <= 40 && !strings.Contains(metadata[k], "\n"),
+		})
+	}
+
 	payload := &chat.Message{}
 	payload.Text = "Deployment " + verb
 
 	payload.AddAttachment(&chat.Attachment{
-		Color: msgColor,
-		Text:  "```\n" + content + "```",
-		Fields: []*chat.Field{
-			{
-				Title: "Host",
-				Value: hostname,
-				Short: true,
-			},
-			{
-				Title: "Deployment-ID",
-				Value: deploymentID,
-				Short: true,
-			},
-			{
-				Title: "Software Identifier",
-				Value: cfg.SoftwareIdentifier,
-				Short: true,
-			},
-		},
+		Color:  msgColor,
+		Text:   "```\n" + content + "```",
+		Fields: fields,
 		Footer: "deploy " + version,
 	})
 
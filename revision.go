@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	revisionArchiveDir  = "deployment-archive"
+	revisionBundleName  = "bundle"
+	revisionLastSuccess = "last-successful"
+	revisionManifest    = "install-manifest"
+	revisionDirPerm     = 0755
+	revisionFilePerm    = 0600
+	revisionTempPrefix  = ".tmp-"
+)
+
+// revisionStore keeps the deployments of an identifier on disk: Each
+// deployment directory contains the bundle and the extracted bundle
+// (deployment-archive) the hooks are executed in. The bundle of the last
+// successful deployment is used to execute its ApplicationStop hooks
+// before the next deployment is installed.
+type revisionStore struct {
+	dir string
+}
+
+func newRevisionStore(root, identifier string) (*revisionStore, error) {
+	dir := path.Join(root, identifier)
+	if err := os.MkdirAll(dir, revisionDirPerm); err != nil {
+		return nil, fmt.Errorf("Unable to create revision directory: %s", err)
+	}
+	return &revisionStore{dir: dir}, nil
+}
+
+// ArchiveDir returns the directory the bundle of the given deployment is
+// extracted to
+func (r revisionStore) ArchiveDir(deploymentID string) string {
+	return path.Join(r.dir, deploymentID, revisionArchiveDir)
+}
+
+// Last returns the ID of the last successful deployment, an empty string
+// if there is none
+func (r revisionStore) Last() (string, error) {
+	raw, err := ioutil.ReadFile(path.Join(r.dir, revisionLastSuccess))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("Unable to read last successful deployment: %s", err)
+	}
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// Open returns the retained bundle of the given deployment and its name
+// for the archive format detection. If the bundle is not available
+// os.ErrNotExist is returned.
+func (r revisionStore) Open(deploymentID string) (*deploymentArtifact, string, error) {
+	if err := validateDeploymentID(deploymentID); err != nil {
+		return nil, "", err
+	}
+
+	files, err := ioutil.ReadDir(path.Join(r.dir, deploymentID))
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() || !strings.HasPrefix(fi.Name(), revisionBundleName) {
+			continue
+		}
+
+		f, err := os.Open(path.Join(r.dir, deploymentID, fi.Name()))
+		if err != nil {
+			return nil, "", err
+		}
+		return &deploymentArtifact{File: f, Size: fi.Size()}, fi.Name(), nil
+	}
+
+	return nil, "", os.ErrNotExist
+}
+
+// Prepare retains the bundle of the given deployment and extracts it
+// into the deployment-archive directory which is returned. A previous
+// attempt of the same deployment is replaced.
+func (r revisionStore) Prepare(deploymentID string, artifact *deploymentArtifact, name string, archive deploymentArchive) (string, error) {
+	tmp, err := ioutil.TempDir(r.dir, revisionTempPrefix)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create revision directory: %s", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Chmod(tmp, revisionDirPerm); err != nil {
+		return "", fmt.Errorf("Unable to set mode of revision directory: %s", err)
+	}
+
+	// Keep the archive extension as fallback for the format detection
+	bundle := revisionBundleName + strings.TrimPrefix(name, trimArchiveExtension(name))
+
+	f, err := os.OpenFile(path.Join(tmp, bundle), os.O_WRONLY|os.O_CREATE|os.O_EXCL, revisionFilePerm)
+	if err != nil {
+		return "", fmt.Errorf("Unable to create bundle: %s", err)
+	}
+
+	if _, err := io.Copy(f, io.NewSectionReader(artifact, 0, artifact.Size)); err != nil {
+		f.Close()
+		return "", fmt.Errorf("Unable to write bundle: %s", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("Unable to write bundle: %s", err)
+	}
+
+	if err := extractArchive(archive, path.Join(tmp, revisionArchiveDir)); err != nil {
+		return "", fmt.Errorf("Unable to extract bundle: %s", err)
+	}
+
+	target := path.Join(r.dir, deploymentID)
+	if err := os.RemoveAll(target); err != nil {
+		return "", fmt.Errorf("Unable to remove previous attempt: %s", err)
+	}
+
+	if err := os.Rename(tmp, target); err != nil {
+		return "", fmt.Errorf("Unable to move bundle into place: %s", err)
+	}
+
+	return r.ArchiveDir(deploymentID), nil
+}
+
+// WriteManifest records the files installed by the given deployment
+func (r revisionStore) WriteManifest(deploymentID string, files []string) error {
+	content := ""
+	for _, f := range files {
+		content += f + "\n"
+	}
+
+	if err := ioutil.WriteFile(path.Join(r.dir, deploymentID, revisionManifest), []byte(content), revisionFilePerm); err != nil {
+		return fmt.Errorf("Unable to write install manifest: %s", err)
+	}
+	return nil
+}
+
+// ReadManifest returns the files installed by the given deployment, an
+// empty set if no manifest was recorded
+func (r revisionStore) ReadManifest(deploymentID string) (map[string]bool, error) {
+	files := map[string]bool{}
+
+	raw, err := ioutil.ReadFile(path.Join(r.dir, deploymentID, revisionManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		return nil, fmt.Errorf("Unable to read install manifest: %s", err)
+	}
+
+	for _, f := range strings.Split(string(raw), "\n") {
+		if f != "" {
+			files[f] = true
+		}
+	}
+
+	return files, nil
+}
+
+// MarkSuccessful stores the given deployment as the last successful one
+func (r revisionStore) MarkSuccessful(deploymentID string) error {
+	if err := ioutil.WriteFile(path.Join(r.dir, revisionLastSuccess), []byte(deploymentID+"\n"), revisionFilePerm); err != nil {
+		return fmt.Errorf("Unable to write last successful deployment: %s", err)
+	}
+	return nil
+}
+
+// Cleanup removes the directories of the oldest deployments to keep only
+// the given number of deployments. The given deployment (the one just
+// executed) and the last successful deployment are never removed.
+func (r revisionStore) Cleanup(retain int, current string) error {
+	last, err := r.Last()
+	if err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return fmt.Errorf("Unable to list deployment directories: %s", err)
+	}
+
+	// Newest deployments first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+
+	kept := 0
+	for _, fi := range files {
+		if !fi.IsDir() {
+			continue
+		}
+
+		keep := !strings.HasPrefix(fi.Name(), revisionTempPrefix) &&
+			(fi.Name() == current || fi.Name() == last || kept < retain)
+		if keep {
+			kept++
+			continue
+		}
+
+		if err := os.RemoveAll(path.Join(r.dir, fi.Name())); err != nil {
+			return fmt.Errorf("Unable to remove deployment directory %q: %s", fi.Name(), err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"aead.dev/minisign"
+	log "github.com/sirupsen/logrus"
+)
+
+const signatureSuffix = ".sig"
+
+// loadTrustedKeys parses the given minisign public keys which are either
+// given directly or as path to a public key file
+func loadTrustedKeys(keys []string) ([]minisign.PublicKey, error) {
+	var trusted []minisign.PublicKey
+
+	for _, k := range keys {
+		if k == "" {
+			continue
+		}
+
+		if _, err := os.Stat(k); err == nil {
+			raw, err := ioutil.ReadFile(k)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to read public key file %q: %s", k, err)
+			}
+			k = string(raw)
+		}
+
+		var pk minisign.PublicKey
+		if err := pk.UnmarshalText([]byte(strings.TrimSpace(k))); err != nil {
+			return nil, fmt.Errorf("Unable to parse public key %q: %s", k, err)
+		}
+
+		trusted = append(trusted, pk)
+	}
+
+	return trusted, nil
+}
+
+// verifyArtifactSignature checks the detached signature stored next to
+// the artifact against the trusted keys. If no keys are configured the
+// verification is skipped.
+func verifyArtifactSignature(storage storageProvider, identifier, deploymentID string, artifact *deploymentArtifact, logger *log.Entry) error {
+	if len(trustedKeys) == 0 {
+		return nil
+	}
+
+	name := artifactNaming.Name(identifier, deploymentID) + signatureSuffix
+
+	buf := new(bytes.Buffer)
+	if err := storage.GetObject(name, buf); err != nil {
+		if err == errNoSuchObject {
+			return fmt.Errorf("Signature %q not found", name)
+		}
+		return fmt.Errorf("Unable to fetch signature %q: %s", name, err)
+	}
+
+	var sig minisign.Signature
+	if err := sig.UnmarshalText(buf.Bytes()); err != nil {
+		return fmt.Errorf("Unable to parse signature %q: %s", name, err)
+	}
+
+	for _, key := range trustedKeys {
+		if key.ID() != sig.KeyID {
+			continue
+		}
+
+		valid, err := verifyMinisign(key, sig, buf.Bytes(), io.NewSectionReader(artifact, 0, artifact.Size))
+		if err != nil {
+			return fmt.Errorf("Unable to read artifact: %s", err)
+		}
+		if !valid {
+			return fmt.Errorf("Signature %q is invalid", name)
+		}
+
+		logger.WithFields(log.Fields{
+			"key_id":          fmt.Sprintf("%016X", key.ID()),
+			"trusted_comment": sig.TrustedComment,
+		}).Info("Artifact signature verified")
+		return nil
+	}
+
+	return fmt.Errorf("Signature %q was not created by a trusted key", name)
+}
+
+// verifyMinisign checks the signature and its trusted comment. Pre-hashed
+// signatures are verified while streaming the artifact, the artifact of
+// legacy signatures is read into memory.
+func verifyMinisign(key minisign.PublicKey, sig minisign.Signature, rawSig []byte, artifact io.Reader) (bool, error) {
+	if sig.Algorithm == minisign.HashEdDSA {
+		r := minisign.NewReader(artifact)
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			return false, err
+		}
+		return r.Verify(key, rawSig), nil
+	}
+
+	message, err := ioutil.ReadAll(artifact)
+	if err != nil {
+		return false, err
+	}
+	return minisign.Verify(key, message, rawSig), nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"aead.dev/minisign"
+	log "github.com/sirupsen/logrus"
+)
+
+// Key and signatures of the message "test" created by the minisign tool
+// (taken from the tests of github.com/jedisct1/go-minisign)
+const (
+	testMinisignPublicKey = "RWQf6LRCGA9i53mlYecO4IzT51TGPpvWucNSCh1CBM0QTaLn73Y7GFO3"
+
+	testMinisignLegacy = "untrusted comment: signature from minisign secret key\n" +
+		"RWQf6LRCGA9i59SLOFxz6NxvASXDJeRtuZykwQepbDEGt87ig1BNpWaVWuNrm73YiIiJbq71Wi+dP9eKL8OC351vwIasSSbXxwA=\n" +
+		"trusted comment: timestamp:1635442742\tfile:test\n" +
+		"0YteLgV960ia80vnA/fHbvkyjl/IoP/HNOCaZfrF0CdhAlp7ok+Tpkya+VpWPX5C/Is3q8a/kEDSY7fBmmgJCg==\n"
+
+	testMinisignPrehashed = "untrusted comment: signature from minisign secret key\n" +
+		"RUQf6LRCGA9i559r3g7V1qNyJDApGip8MfqcadIgT9CuhV3EMhHoN1mGTkUidF/z7SrlQgXdy8ofjb7bNJJylDOocrCo8KLzZwo=\n" +
+		"trusted comment: timestamp:1635443258\tfile:test\thashed\n" +
+		"/cj37GK60vryibFn+ftOgbCvW9NKhKYgjVpFFQUcWPAnjO23wrvVDTt7cloNC06maoBli9q6qwZDXXoaxweICQ==\n"
+)
+
+func verifyTestSignature(t *testing.T, message, signature string) error {
+	storage := &fakeStorage{objects: map[string]string{}}
+	if signature != "" {
+		storage.objects["default1.zip.sig"] = signature
+	}
+
+	artifact := openTestArtifact(t, "default1.zip", []byte(message))
+	defer artifact.Close()
+
+	return verifyArtifactSignature(storage, "default", "1", artifact, log.NewEntry(log.StandardLogger()))
+}
+
+func TestVerifyArtifactSignature(t *testing.T) {
+	defer func(keys []minisign.PublicKey) { trustedKeys = keys }(trustedKeys)
+
+	var err error
+	if trustedKeys, err = loadTrustedKeys([]string{testMinisignPublicKey}); err != nil {
+		t.Fatalf("Unable to load public key: %s", err)
+	}
+
+	for name, c := range map[string]struct {
+		message, signature string
+		valid              bool
+	}{
+		"legacy":                        {message: "test", signature: testMinisignLegacy, valid: true},
+		"prehashed":                     {message: "test", signature: testMinisignPrehashed, valid: true},
+		"legacy tampered message":       {message: "tested", signature: testMinisignLegacy},
+		"prehashed tampered message":    {message: "tested", signature: testMinisignPrehashed},
+		"legacy tampered comment":       {message: "test", signature: strings.Replace(testMinisignLegacy, "1635442742", "1635442743", 1)},
+		"prehashed tampered comment":    {message: "test", signature: strings.Replace(testMinisignPrehashed, "file:test", "file:prod", 1)},
+		"prehashed signature as legacy": {message: "test", signature: strings.Replace(testMinisignPrehashed, "RUQf6", "RWQf6", 1)},
+		"missing signature":             {message: "test"},
+		"malformed signature":           {message: "test", signature: "untrusted comment: test\nRWQ=\n"},
+	} {
+		if err := verifyTestSignature(t, c.message, c.signature); (err == nil) != c.valid {
+			t.Errorf("%s: Expected valid=%v, got %v", name, c.valid, err)
+		}
+	}
+}
+
+func TestVerifyArtifactSignatureKeyFile(t *testing.T) {
+	defer func(keys []minisign.PublicKey) { trustedKeys = keys }(trustedKeys)
+
+	message, err := ioutil.ReadFile("testdata/minisign/message.txt")
+	if err != nil {
+		t.Fatalf("Unable to read message: %s", err)
+	}
+	signature, err := ioutil.ReadFile("testdata/minisign/message.txt.minisig")
+	if err != nil {
+		t.Fatalf("Unable to read signature: %s", err)
+	}
+
+	// Signature created by a key not being trusted
+	if trustedKeys, err = loadTrustedKeys([]string{testMinisignPublicKey}); err != nil {
+		t.Fatalf("Unable to load public key: %s", err)
+	}
+	if err := verifyTestSignature(t, string(message), string(signature)); err == nil {
+		t.Error("Signature of an untrusted key was accepted")
+	}
+
+	// The file of the minisign tool contains an untrusted comment
+	if trustedKeys, err = loadTrustedKeys([]string{testMinisignPublicKey, "testdata/minisign/minisign.pub"}); err != nil {
+		t.Fatalf("Unable to load public key file: %s", err)
+	}
+	if err := verifyTestSignature(t, string(message), string(signature)); err != nil {
+		t.Errorf("Valid signature was rejected: %s", err)
+	}
+}